@@ -1,24 +1,97 @@
 package command
 
 import (
-	"errors"
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/lightstaff/go-dddcqrses/common"
 	"github.com/lightstaff/go-dddcqrses/events"
 )
 
+// todoSnapshotSchemaVersion is schema version of todoSnapshot
+const todoSnapshotSchemaVersion = 4
+
+// maxMessageLength is max length of message in runes
+const maxMessageLength = 1000
+
+// domain errors
+var (
+	ErrTodoNotFound          = common.NewDomainError("todo_not_found", "todo not found")
+	ErrTodoAlreadyRegistered = common.NewDomainError("todo_already_registered", "todo already registered")
+	ErrTodoDeleted           = common.NewDomainError("todo_deleted", "todo deleted")
+	ErrTodoShredded          = common.NewDomainError("todo_shredded", "todo shredded")
+	ErrAlreadyCompleted      = common.NewDomainError("already_completed", "todo already completed")
+	ErrNotCompleted          = common.NewDomainError("not_completed", "todo not completed")
+	ErrInvalidMessage        = common.NewDomainError("invalid_message", "message must be 1 to 1000 characters")
+	ErrMessageUnchanged      = common.NewDomainError("message_unchanged", "message unchanged")
+)
+
+// todoSnapshot is snapshot data of Todo
+type todoSnapshot struct {
+	Owner     string
+	Message   string
+	Completed bool
+	Deleted   bool
+	Shredded  bool
+}
+
 // Todo is Todo aggregate root
+//
+// Register, ChangeMessage, Complete, Delete and Shred decide events against current state
+// and reject commands with domain errors, handlers of todoRouter only apply events.
 type Todo struct {
 	*common.AggregateBase
-	message   string
-	completed bool
+	registered bool
+	owner      string
+	message    string
+	completed  bool
+	deleted    bool
+	shredded   bool
+}
+
+// todoRouter is apply handlers of Todo
+var todoRouter = newTodoRouter()
+
+// newTodoRouter is new apply handlers of Todo, panic when a todo event is not handled
+func newTodoRouter() *common.EventRouter[*Todo] {
+	r := common.NewEventRouter[*Todo]()
+	common.On(r, func(t *Todo, e *events.TodoRegistered) {
+		t.registered = true
+		t.owner = e.Owner
+		t.message = e.Message
+		t.completed = e.Completed
+	})
+	common.On(r, func(t *Todo, e *events.TodoMessageChanged) {
+		t.message = e.Message
+	})
+	common.On(r, func(t *Todo, e *events.TodoCompleted) {
+		t.completed = e.Completed
+	})
+	common.On(r, func(t *Todo, e *events.TodoDeleted) {
+		t.deleted = true
+	})
+	common.On(r, func(t *Todo, e *events.TodoShredded) {
+		t.message = ""
+		t.shredded = true
+	})
+	return r.MustHandle(events.TodoEvents()...)
 }
 
 // NewTodo is new Todo
 func NewTodo(id string) *Todo {
-	return &Todo{
+	t := &Todo{
 		AggregateBase: common.NewAggregateBase(id),
 	}
+	t.SetEventHandler(func(e common.EventContext) error {
+		return todoRouter.Route(t, e)
+	}, events.EventConverter)
+	return t
+}
+
+// Owner is principal id registering todo, empty for todos registered before owners were recorded
+func (t *Todo) Owner() string {
+	return t.owner
 }
 
 // Message is message
@@ -31,42 +104,144 @@ func (t *Todo) Completed() bool {
 	return t.completed
 }
 
-// RaiseEvent is raise event
-func (t *Todo) RaiseEvent(e common.EventContext, n bool) error {
-	switch e := e.(type) {
-	case *events.TodoRegistered:
-		t.message = e.Message
-		t.completed = e.Completed
-	case *events.TodoMessageChanged:
-		t.message = e.Message
-	case *events.TodoCompleted:
-		t.completed = e.Completed
-	default:
-		return errors.New("unknown event")
+// Deleted is deleted (tombstoned)
+func (t *Todo) Deleted() bool {
+	return t.deleted
+}
+
+// Register is register todo owned by owner
+func (t *Todo) Register(owner, message string, completed bool) error {
+	if t.registered {
+		return ErrTodoAlreadyRegistered
+	}
+	if err := validateMessage(message); err != nil {
+		return err
+	}
+	e, err := events.NewTodoRegistered(t.AggregateID(), owner, message, completed)
+	if err != nil {
+		return err
+	}
+	return t.Raise(e)
+}
+
+// ChangeMessage is change message of not completed todo, the message of a shredded todo is not written again
+func (t *Todo) ChangeMessage(message string) error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
+	if t.shredded {
+		return ErrTodoShredded
 	}
+	if t.completed {
+		return ErrAlreadyCompleted
+	}
+	if err := validateMessage(message); err != nil {
+		return err
+	}
+	if message == t.message {
+		return ErrMessageUnchanged
+	}
+	e, err := events.NewTodoMessageChanged(t.AggregateID(), message)
+	if err != nil {
+		return err
+	}
+	return t.Raise(e)
+}
 
-	if n {
-		t.AppendUncommittedEvent(e)
+// Complete is complete todo, or reopen it when completed is false
+func (t *Todo) Complete(completed bool) error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
+	if completed && t.completed {
+		return ErrAlreadyCompleted
+	}
+	if !completed && !t.completed {
+		return ErrNotCompleted
 	}
+	e, err := events.NewTodoCompleted(t.AggregateID(), completed)
+	if err != nil {
+		return err
+	}
+	return t.Raise(e)
+}
 
-	return nil
+// Delete is delete todo (tombstone)
+func (t *Todo) Delete() error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
+	e, err := events.NewTodoDeleted(t.AggregateID())
+	if err != nil {
+		return err
+	}
+	return t.Raise(e)
 }
 
-// Replay is replay events (common.AggreateContext interface)
-func (t *Todo) Replay(storedEvents []*common.StoredEvent) error {
-	for _, storedEvent := range storedEvents {
-		e, err := events.EventConverter(storedEvent.EventType, storedEvent.Data)
-		if err != nil {
-			return err
-		}
+// Shred is forget personal data of todo, deleted todos are shredded too
+//
+// Shredding a shredded todo raises nothing, so a shred failed after its event is saved can be retried.
+func (t *Todo) Shred() error {
+	if !t.registered {
+		return ErrTodoNotFound
+	}
+	if t.shredded {
+		return nil
+	}
+	e, err := events.NewTodoShredded(t.AggregateID())
+	if err != nil {
+		return err
+	}
+	return t.Raise(e)
+}
 
-		if err := t.RaiseEvent(e, false); err != nil {
-			return err
-		}
+// checkActive is check todo is registered and not deleted
+func (t *Todo) checkActive() error {
+	if !t.registered {
+		return ErrTodoNotFound
+	}
+	if t.deleted {
+		return ErrTodoDeleted
+	}
+	return nil
+}
 
-		t.CommitEvent(e)
-		t.SetStreamVersion(storedEvent.StreamVersion)
+// validateMessage is validate message
+func validateMessage(message string) error {
+	if strings.TrimSpace(message) == "" || utf8.RuneCountInString(message) > maxMessageLength {
+		return ErrInvalidMessage
 	}
+	return nil
+}
+
+// SnapshotSchemaVersion is snapshot schema version (common.SnapshotAggregateContext interface)
+func (t *Todo) SnapshotSchemaVersion() int {
+	return todoSnapshotSchemaVersion
+}
 
+// MarshalSnapshot is marshal state (common.SnapshotAggregateContext interface)
+func (t *Todo) MarshalSnapshot() ([]byte, error) {
+	return json.Marshal(&todoSnapshot{
+		Owner:     t.owner,
+		Message:   t.message,
+		Completed: t.completed,
+		Deleted:   t.deleted,
+		Shredded:  t.shredded,
+	})
+}
+
+// UnmarshalSnapshot is restore state (common.SnapshotAggregateContext interface)
+func (t *Todo) UnmarshalSnapshot(data []byte) error {
+	var s todoSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	// snapshots are only taken of registered todos
+	t.registered = true
+	t.owner = s.Owner
+	t.message = s.Message
+	t.completed = s.Completed
+	t.deleted = s.Deleted
+	t.shredded = s.Shredded
 	return nil
 }
@@ -1,114 +1,345 @@
 package command
 
 import (
-	"errors"
+	"context"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/lightstaff/go-dddcqrses/common"
-	"github.com/lightstaff/go-dddcqrses/events"
 	"github.com/lightstaff/go-dddcqrses/messages"
 )
 
+// CommandMetadata is metadata of command, forwarded to events and messages
+//
+// CommandID is generated per dispatch when empty, CorrelationID defaults to CommandID.
+type CommandMetadata struct {
+	CommandID     string
+	CorrelationID string
+	UserID        string
+	Headers       map[string]string
+}
+
+// eventMetadata is metadata of events caused by command
+func (m *CommandMetadata) eventMetadata() (common.EventMetadata, error) {
+	commandID := m.CommandID
+	if commandID == "" {
+		id, err := common.NewCommandID()
+		if err != nil {
+			return common.EventMetadata{}, err
+		}
+		commandID = id
+	}
+	correlationID := m.CorrelationID
+	if correlationID == "" {
+		correlationID = commandID
+	}
+	headers := make(map[string]string, len(m.Headers))
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	return common.EventMetadata{
+		CorrelationID: correlationID,
+		CausationID:   commandID,
+		UserID:        m.UserID,
+		Headers:       headers,
+	}, nil
+}
+
 // commands
 type (
 	TodoRegistry struct {
+		CommandMetadata
 		Message   string
 		Completed bool
 	}
 
 	TodoMessageChange struct {
+		CommandMetadata
 		AggregateID string
 		Message     string
 	}
 
 	TodoComplete struct {
+		CommandMetadata
 		AggregateID string
 		Completed   bool
 	}
+
+	TodoDelete struct {
+		CommandMetadata
+		AggregateID string
+	}
 )
 
-// TodoActor is actor system for todo
+// todo actions authorized by policy
+const (
+	ActionTodoRegister      = "todo.register"
+	ActionTodoChangeMessage = "todo.change_message"
+	ActionTodoComplete      = "todo.complete"
+	ActionTodoDelete        = "todo.delete"
+	ActionTodoHardDelete    = "todo.hard_delete"
+	ActionTodoShred         = "todo.shred"
+)
+
+// roles of DefaultTodoPolicy
+const (
+	RoleTodoUser  = "todo.user"
+	RoleTodoAdmin = "todo.admin"
+)
+
+// DefaultTodoPolicy is policy that users register todos and only owners (or admins) act on them
+//
+// The owner rule covers any action, so it also allows owners to read their todos on query side.
+func DefaultTodoPolicy() *common.PolicyEngine {
+	return common.NewPolicyEngine(
+		&common.PolicyRule{Name: "admin", Roles: []string{RoleTodoAdmin}},
+		&common.PolicyRule{Name: "user-register", Actions: []string{ActionTodoRegister}, Roles: []string{RoleTodoUser}},
+		&common.PolicyRule{Name: "owner", Condition: common.IsOwner},
+	)
+}
+
+// DefaultCommittedEventLimit is default number of committed events kept by todos in actors
+const DefaultCommittedEventLimit = 100
+
+// TodoActor is actor system for todo, handling todo commands dispatched by common.CommandBus
+//
+// Commands to one todo run serialized in its actor (common.ActorSystem).
 type TodoActor struct {
-	persistence common.PersistenceContext
-	producer    common.MessagingProducerContext
-	logger      *zap.SugaredLogger
+	persistence    common.PersistenceContext
+	todos          *common.Repository[*Todo]
+	actors         *common.ActorSystem[*Todo]
+	processed      common.ProcessedCommandStore
+	policy         common.Policy
+	committedLimit int
+	logger         *zap.SugaredLogger
 }
 
-// NewTodoActor is new todo actor
-func NewTodoActor(persistence common.PersistenceContext, producer common.MessagingProducerContext, logger *zap.SugaredLogger) *TodoActor {
-	return &TodoActor{
-		persistence: persistence,
-		producer:    producer,
-		logger:      logger,
+// NewTodoActor is new todo actor, processed may be nil to disable duplicate detection
+func NewTodoActor(persistence common.PersistenceContext, processed common.ProcessedCommandStore, logger *zap.SugaredLogger) *TodoActor {
+	t := &TodoActor{
+		persistence:    persistence,
+		processed:      processed,
+		committedLimit: DefaultCommittedEventLimit,
+		logger:         logger,
 	}
+	t.todos = common.NewRepository(persistence, t.newTodo)
+	t.actors = common.NewActorSystem(t.todos, common.DefaultActorIdleTimeout, common.DefaultMaxActors, logger)
+	return t
 }
 
-// Act is actor action
-func (t *TodoActor) Act(command interface{}) error {
-	switch command := command.(type) {
-	case *TodoRegistry:
-		aggregateID, err := common.NewAggregateID()
-		if err != nil {
-			return err
-		}
-		entity := NewTodo(aggregateID)
-		e, err := events.NewTodoRegistered(aggregateID, command.Message, command.Completed)
+// newTodo is new todo kept in actor, bounded to committedLimit committed events
+func (t *TodoActor) newTodo(id string) *Todo {
+	todo := NewTodo(id)
+	todo.SetCommittedEventLimit(t.committedLimit)
+	return todo
+}
+
+// SetCommittedEventLimit is keep only the last limit committed events of todos in actors, limit <= 0 keeps all, call before handling commands
+func (t *TodoActor) SetCommittedEventLimit(limit int) {
+	t.committedLimit = limit
+}
+
+// SetPassivation is replace actors with ones passivated after idleTimeout and bounded to maxActors, call before handling commands
+func (t *TodoActor) SetPassivation(idleTimeout time.Duration, maxActors int) {
+	t.actors.Close()
+	t.actors = common.NewActorSystem(t.todos, idleTimeout, maxActors, t.logger)
+}
+
+// SetPolicy is set policy authorizing commands for principal of context, nil disables authorization
+func (t *TodoActor) SetPolicy(policy common.Policy) {
+	t.policy = policy
+}
+
+// Close is stop actors after their pending commands
+func (t *TodoActor) Close() {
+	t.actors.Close()
+}
+
+// HardDelete is save TodoHardDeleted message so read models drop the todo, then physically delete todo
+// (common.PersistenceContext.DeleteAggregate) in its actor, and drop the cached todo
+func (t *TodoActor) HardDelete(ctx context.Context, aggregateID string) error {
+	return t.actors.Invalidate(ctx, aggregateID, func(ctx context.Context, entity *Todo) error {
+		metadata, err := t.authorize(ctx, ActionTodoHardDelete, entity, common.EventMetadata{})
 		if err != nil {
 			return err
 		}
-		if err := entity.RaiseEvent(e, true); err != nil {
-			return err
-		}
-		if err := t.persistence.Save(entity); err != nil {
-			return err
-		}
-		m, err := messages.NewTodoEventOccurred(entity.AggregateID(), entity.StreamVersion())
+		m, err := messages.NewTodoHardDeleted(aggregateID, metadata)
 		if err != nil {
 			return err
 		}
-		if err := t.producer.Publish(m); err != nil {
+		if err := t.todos.Save(ctx, entity, m); err != nil {
 			return err
 		}
-	case *TodoMessageChange:
-		entity := NewTodo(command.AggregateID)
-		e, err := events.NewTodoMessageChanged(command.AggregateID, command.Message)
+		return t.persistence.DeleteAggregate(ctx, aggregateID)
+	})
+}
+
+// Shred is raise TodoShredded so read models drop the message, then destroy personal data of todo
+// (common.PersistenceContext.ShredAggregate) in its actor, and drop the cached todo holding it in plain
+func (t *TodoActor) Shred(ctx context.Context, aggregateID string, command *CommandMetadata) error {
+	metadata, err := command.eventMetadata()
+	if err != nil {
+		return err
+	}
+	return t.actors.Invalidate(ctx, aggregateID, func(ctx context.Context, entity *Todo) error {
+		metadata, err := t.authorize(ctx, ActionTodoShred, entity, metadata)
 		if err != nil {
 			return err
 		}
-		if err := entity.RaiseEvent(e, true); err != nil {
+		entity.SetEventMetadata(metadata)
+		if err := entity.Shred(); err != nil {
 			return err
 		}
-		if err := t.persistence.Save(entity); err != nil {
-			return err
+		if len(entity.UncommittedEvents()) > 0 {
+			if _, err := t.save(ctx, entity, metadata); err != nil {
+				return err
+			}
 		}
-		m, err := messages.NewTodoEventOccurred(entity.AggregateID(), entity.StreamVersion())
+		return t.persistence.ShredAggregate(ctx, aggregateID)
+	})
+}
+
+// RegisterHandlers is register handlers of todo commands to bus
+func (t *TodoActor) RegisterHandlers(bus *common.CommandBus) {
+	common.Register(bus, func(ctx context.Context, command *TodoRegistry) (*common.CommandResult, error) {
+		return t.register(ctx, command)
+	})
+	common.Register(bus, func(ctx context.Context, command *TodoMessageChange) (*common.CommandResult, error) {
+		return t.changeMessage(ctx, command)
+	})
+	common.Register(bus, func(ctx context.Context, command *TodoComplete) (*common.CommandResult, error) {
+		return t.complete(ctx, command)
+	})
+	common.Register(bus, func(ctx context.Context, command *TodoDelete) (*common.CommandResult, error) {
+		return t.delete(ctx, command)
+	})
+}
+
+// RegisterValidationRules is register validation rules of todo commands, checked by common.ValidationMiddleware
+func RegisterValidationRules(v *common.CommandValidator) {
+	common.AddRules(v,
+		common.Required("Message", func(c *TodoRegistry) string { return c.Message }),
+		common.MaxLength("Message", maxMessageLength, func(c *TodoRegistry) string { return c.Message }),
+	)
+	common.AddRules(v,
+		common.Required("AggregateID", func(c *TodoMessageChange) string { return c.AggregateID }),
+		common.Required("Message", func(c *TodoMessageChange) string { return c.Message }),
+		common.MaxLength("Message", maxMessageLength, func(c *TodoMessageChange) string { return c.Message }),
+	)
+	common.AddRules(v,
+		common.Required("AggregateID", func(c *TodoComplete) string { return c.AggregateID }),
+	)
+	common.AddRules(v,
+		common.Required("AggregateID", func(c *TodoDelete) string { return c.AggregateID }),
+	)
+}
+
+// register is handle TodoRegistry
+func (t *TodoActor) register(ctx context.Context, command *TodoRegistry) (*common.CommandResult, error) {
+	owner := ""
+	if principal := common.PrincipalFrom(ctx); principal != nil {
+		owner = principal.ID
+	}
+	// a duplicate registry by the same principal goes to the same todo, so it is detected there
+	aggregateID := common.DeriveAggregateID(owner + "/" + command.CommandID)
+	if command.CommandID == "" {
+		id, err := common.NewAggregateID()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if err := t.producer.Publish(m); err != nil {
-			return err
-		}
-	case *TodoComplete:
-		entity := NewTodo(command.AggregateID)
-		e, err := events.NewTodoCompleted(command.AggregateID, command.Completed)
+		aggregateID = id
+	}
+	return t.ask(ctx, aggregateID, ActionTodoRegister, &command.CommandMetadata, func(entity *Todo) error {
+		return entity.Register(owner, command.Message, command.Completed)
+	})
+}
+
+// changeMessage is handle TodoMessageChange
+func (t *TodoActor) changeMessage(ctx context.Context, command *TodoMessageChange) (*common.CommandResult, error) {
+	return t.ask(ctx, command.AggregateID, ActionTodoChangeMessage, &command.CommandMetadata, func(entity *Todo) error {
+		return entity.ChangeMessage(command.Message)
+	})
+}
+
+// complete is handle TodoComplete
+func (t *TodoActor) complete(ctx context.Context, command *TodoComplete) (*common.CommandResult, error) {
+	return t.ask(ctx, command.AggregateID, ActionTodoComplete, &command.CommandMetadata, func(entity *Todo) error {
+		return entity.Complete(command.Completed)
+	})
+}
+
+// delete is handle TodoDelete, raise tombstone
+func (t *TodoActor) delete(ctx context.Context, command *TodoDelete) (*common.CommandResult, error) {
+	return t.ask(ctx, command.AggregateID, ActionTodoDelete, &command.CommandMetadata, func(entity *Todo) error {
+		return entity.Delete()
+	})
+}
+
+// ask is authorize action and decide events on todo in its actor, and save them
+//
+// An authorized command with client supplied CommandID already processed on the todo returns its original result.
+func (t *TodoActor) ask(ctx context.Context, aggregateID, action string, command *CommandMetadata, decide func(entity *Todo) error) (*common.CommandResult, error) {
+	supplied := command.CommandID != ""
+	metadata, err := command.eventMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return t.actors.Ask(ctx, aggregateID, func(ctx context.Context, entity *Todo) (*common.CommandResult, error) {
+		metadata, err := t.authorize(ctx, action, entity, metadata)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if err := entity.RaiseEvent(e, true); err != nil {
-			return err
-		}
-		if err := t.persistence.Save(entity); err != nil {
-			return err
-		}
-		m, err := messages.NewTodoEventOccurred(entity.AggregateID(), entity.StreamVersion())
-		if err != nil {
-			return err
+		// after authorization, so a replayed command id does not reveal the result to other principals
+		if supplied && t.processed != nil {
+			result, err := t.processed.FindProcessed(ctx, aggregateID, metadata.CausationID)
+			if err != nil {
+				return nil, err
+			}
+			if result != nil {
+				t.logger.Infow("skip duplicate command", "commandID", metadata.CausationID, "aggregateID", aggregateID)
+				return result, nil
+			}
 		}
-		if err := t.producer.Publish(m); err != nil {
-			return err
+		entity.SetEventMetadata(metadata)
+		if err := decide(entity); err != nil {
+			return nil, err
 		}
+		return t.save(ctx, entity, metadata)
+	})
+}
+
+// authorize is check policy for action on entity, metadata with the decision recorded
+func (t *TodoActor) authorize(ctx context.Context, action string, entity *Todo, metadata common.EventMetadata) (common.EventMetadata, error) {
+	if t.policy == nil {
+		return metadata, nil
+	}
+	decision, err := common.Authorize(ctx, t.policy, action, entity.AggregateID(), map[string]string{
+		common.AttributeOwner: entity.Owner(),
+	})
+	if err != nil {
+		return metadata, err
 	}
+	return decision.Record(metadata), nil
+}
 
-	return errors.New("unknown command")
+// save is save entity with TodoEventOccurred message to outbox
+func (t *TodoActor) save(ctx context.Context, entity *Todo, metadata common.EventMetadata) (*common.CommandResult, error) {
+	m, err := messages.NewTodoEventOccurred(entity.AggregateID(), entity.StreamVersion()+int64(len(entity.UncommittedEvents())), metadata)
+	if err != nil {
+		return nil, err
+	}
+	uncommittedEvents := entity.UncommittedEvents()
+	eventIDs := make([]string, 0, len(uncommittedEvents))
+	for _, e := range uncommittedEvents {
+		eventIDs = append(eventIDs, e.GetEventID())
+	}
+	if err := t.todos.Save(ctx, entity, m); err != nil {
+		return nil, err
+	}
+	return &common.CommandResult{
+		AggregateID:   entity.AggregateID(),
+		StreamVersion: entity.StreamVersion(),
+		EventIDs:      eventIDs,
+	}, nil
 }
@@ -0,0 +1,314 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// actor system defaults
+const (
+	DefaultActorIdleTimeout = 5 * time.Minute
+	DefaultMaxActors        = 10000
+	actorMailboxSize        = 64
+)
+
+// ErrActorSystemClosed is actor system was closed error
+var ErrActorSystemClosed = errors.New("actor system closed")
+
+// ActorSystem is per-aggregate actors over repository
+//
+// Each active aggregate id has a mailbox goroutine handling its commands one at a time
+// and keeping the hydrated aggregate in memory, so concurrent commands to one aggregate are serialized.
+// Actors idle for idleTimeout are passivated, and when maxActors are live
+// the least recently used idle actor is evicted (Ask waits while all actors are busy).
+// Deleting or shredding an aggregate must go through Invalidate, otherwise its actor keeps the old state in memory.
+type ActorSystem[T AggregateContext] struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	repository  *Repository[T]
+	idleTimeout time.Duration
+	maxActors   int
+	actors      map[string]*aggregateActor[T]
+	closed      bool
+	logger      *zap.SugaredLogger
+}
+
+// aggregateActor is actor of one aggregate, pending and lastUsed are guarded by ActorSystem.mu
+type aggregateActor[T AggregateContext] struct {
+	aggregateID string
+	mailbox     chan *actorMessage[T]
+	stop        chan struct{}
+	pending     int
+	lastUsed    time.Time
+}
+
+// actorMessage is command handling sent to actor, the aggregate is dropped after handling when invalidate
+type actorMessage[T AggregateContext] struct {
+	ctx        context.Context
+	handle     func(ctx context.Context, a T) (*CommandResult, error)
+	invalidate bool
+	reply      chan actorReply
+}
+
+// actorReply is reply of actor
+type actorReply struct {
+	result *CommandResult
+	err    error
+}
+
+// NewActorSystem is new actor system, idleTimeout <= 0 disables passivation and maxActors <= 0 disables the bound
+func NewActorSystem[T AggregateContext](repository *Repository[T], idleTimeout time.Duration, maxActors int, logger *zap.SugaredLogger) *ActorSystem[T] {
+	s := &ActorSystem[T]{
+		repository:  repository,
+		idleTimeout: idleTimeout,
+		maxActors:   maxActors,
+		actors:      make(map[string]*aggregateActor[T]),
+		logger:      logger,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Ask is handle command on aggregate in its actor, and wait for result
+//
+// handle gets the hydrated aggregate (new empty one when stream not exists) and must save it.
+// Aggregate left with uncommitted events (failed save, e.g. concurrency conflict) is dropped and reloaded by next command.
+// When ctx is done before the actor takes the command it is not handled, after that Ask returns without waiting for it.
+func (s *ActorSystem[T]) Ask(ctx context.Context, aggregateID string, handle func(ctx context.Context, a T) (*CommandResult, error)) (*CommandResult, error) {
+	return s.send(ctx, aggregateID, &actorMessage[T]{
+		ctx:    ctx,
+		handle: handle,
+		reply:  make(chan actorReply, 1),
+	})
+}
+
+// Invalidate is run handle on aggregate in its actor like Ask, then drop the aggregate so next command reloads it
+//
+// Use it to delete or shred the aggregate in handle, so the actor does not keep (and snapshot) the removed state.
+func (s *ActorSystem[T]) Invalidate(ctx context.Context, aggregateID string, handle func(ctx context.Context, a T) error) error {
+	_, err := s.send(ctx, aggregateID, &actorMessage[T]{
+		ctx: ctx,
+		handle: func(ctx context.Context, a T) (*CommandResult, error) {
+			return nil, handle(ctx, a)
+		},
+		invalidate: true,
+		reply:      make(chan actorReply, 1),
+	})
+	return err
+}
+
+// send is send message to actor of aggregate, and wait for reply
+func (s *ActorSystem[T]) send(ctx context.Context, aggregateID string, m *actorMessage[T]) (*CommandResult, error) {
+	actor, err := s.acquire(ctx, aggregateID)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case actor.mailbox <- m:
+	case <-ctx.Done():
+		s.done(actor)
+		return nil, ctx.Err()
+	}
+	select {
+	case r := <-m.reply:
+		return r.result, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// LiveActors is number of live actors
+func (s *ActorSystem[T]) LiveActors() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.actors)
+}
+
+// Close is stop all actors after their pending commands
+func (s *ActorSystem[T]) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for len(s.actors) > 0 {
+		for id, actor := range s.actors {
+			if actor.pending == 0 {
+				delete(s.actors, id)
+				close(actor.stop)
+			}
+		}
+		if len(s.actors) > 0 {
+			s.cond.Wait()
+		}
+	}
+}
+
+// acquire is get or spawn actor of aggregate and count a pending message on it
+func (s *ActorSystem[T]) acquire(ctx context.Context, aggregateID string) (*aggregateActor[T], error) {
+	var stop chan struct{}
+	defer func() {
+		if stop != nil {
+			close(stop)
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.closed {
+			return nil, ErrActorSystemClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if actor, ok := s.actors[aggregateID]; ok {
+			actor.pending++
+			return actor, nil
+		}
+		if s.maxActors <= 0 || len(s.actors) < s.maxActors || s.evictIdle() {
+			break
+		}
+		// wake on cancel, so waiting for a busy actor to be evicted honors ctx
+		if stop == nil && ctx.Done() != nil {
+			stop = make(chan struct{})
+			go s.wakeOnDone(ctx, stop)
+		}
+		s.cond.Wait()
+	}
+	actor := &aggregateActor[T]{
+		aggregateID: aggregateID,
+		mailbox:     make(chan *actorMessage[T], actorMailboxSize),
+		stop:        make(chan struct{}),
+		pending:     1,
+	}
+	s.actors[aggregateID] = actor
+	go s.run(actor)
+	return actor, nil
+}
+
+// wakeOnDone is wake waiters of acquire when ctx is done before stop is closed
+func (s *ActorSystem[T]) wakeOnDone(ctx context.Context, stop <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cond.Broadcast()
+	case <-stop:
+	}
+}
+
+// evictIdle is stop least recently used idle actor, false when all actors are busy
+func (s *ActorSystem[T]) evictIdle() bool {
+	var oldest *aggregateActor[T]
+	for _, actor := range s.actors {
+		if actor.pending == 0 && (oldest == nil || actor.lastUsed.Before(oldest.lastUsed)) {
+			oldest = actor
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(s.actors, oldest.aggregateID)
+	close(oldest.stop)
+	s.logger.Debugw("evict actor", "aggregateID", oldest.aggregateID)
+	return true
+}
+
+// run is mailbox loop of actor
+func (s *ActorSystem[T]) run(actor *aggregateActor[T]) {
+	var idle <-chan time.Time
+	var timer *time.Timer
+	if s.idleTimeout > 0 {
+		timer = time.NewTimer(s.idleTimeout)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	var aggregate T
+	loaded := false
+	for {
+		select {
+		case m := <-actor.mailbox:
+			if err := m.ctx.Err(); err != nil {
+				m.reply <- actorReply{err: err}
+				s.done(actor)
+				continue
+			}
+			if !loaded {
+				a, err := s.load(m.ctx, actor.aggregateID)
+				if err != nil {
+					m.reply <- actorReply{err: err}
+					s.done(actor)
+					continue
+				}
+				aggregate = a
+				loaded = true
+			}
+			result, err := m.handle(m.ctx, aggregate)
+			if m.invalidate || len(aggregate.UncommittedEvents()) > 0 {
+				var zero T
+				aggregate = zero
+				loaded = false
+			}
+			m.reply <- actorReply{result: result, err: err}
+			s.done(actor)
+			if timer != nil {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(s.idleTimeout)
+			}
+		case <-actor.stop:
+			return
+		case <-idle:
+			if s.passivate(actor) {
+				return
+			}
+			timer.Reset(s.idleTimeout)
+		}
+	}
+}
+
+// load is load aggregate, new empty one when stream not exists
+func (s *ActorSystem[T]) load(ctx context.Context, aggregateID string) (T, error) {
+	a, err := s.repository.Load(ctx, aggregateID)
+	if _, ok := err.(*ErrAggregateNotFound); ok {
+		return s.repository.New(aggregateID), nil
+	}
+	return a, err
+}
+
+// done is count down pending message of actor
+func (s *ActorSystem[T]) done(actor *aggregateActor[T]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	actor.pending--
+	actor.lastUsed = time.Now()
+	s.cond.Broadcast()
+}
+
+// passivate is remove idle actor, false when a message is pending
+func (s *ActorSystem[T]) passivate(actor *aggregateActor[T]) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if actor.pending > 0 {
+		return false
+	}
+	if s.actors[actor.aggregateID] == actor {
+		delete(s.actors, actor.aggregateID)
+	}
+	s.logger.Debugw("passivate actor", "aggregateID", actor.aggregateID)
+	s.cond.Broadcast()
+	return true
+}
@@ -0,0 +1,261 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type testActorAggregate struct {
+	*AggregateBase
+	handled int
+}
+
+type loadCountingPersistence struct {
+	PersistenceContext
+	mu    sync.Mutex
+	loads map[string]int
+}
+
+func (p *loadCountingPersistence) ReplayAggregate(ctx context.Context, a AggregateContext) error {
+	p.mu.Lock()
+	p.loads[a.AggregateID()]++
+	p.mu.Unlock()
+	return p.PersistenceContext.ReplayAggregate(ctx, a)
+}
+
+func (p *loadCountingPersistence) loadsOf(aggregateID string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.loads[aggregateID]
+}
+
+func newTestActorSystem(idleTimeout time.Duration, maxActors int) (*ActorSystem[*testActorAggregate], *loadCountingPersistence) {
+	logger := zap.NewNop().Sugar()
+	persistence := &loadCountingPersistence{
+		PersistenceContext: NewFakePersistence(NewInMemoryDB(logger), logger),
+		loads:              make(map[string]int),
+	}
+	repository := NewRepository(persistence, func(aggregateID string) *testActorAggregate {
+		a := &testActorAggregate{AggregateBase: NewAggregateBase(aggregateID)}
+		a.SetEventHandler(func(EventContext) error { return nil }, func(*StoredEvent) (EventContext, error) { return nil, nil })
+		return a
+	})
+	return NewActorSystem(repository, idleTimeout, maxActors, logger), persistence
+}
+
+func handleNothing(ctx context.Context, a *testActorAggregate) (*CommandResult, error) {
+	return nil, nil
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestActorSystemSerializesCommandsOfAggregate(t *testing.T) {
+	s, persistence := newTestActorSystem(0, 0)
+	defer s.Close()
+
+	const commands = 50
+	var running, overlapped int32
+	var wg sync.WaitGroup
+	for i := 0; i < commands; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Ask(context.Background(), "a", func(ctx context.Context, a *testActorAggregate) (*CommandResult, error) {
+				if atomic.AddInt32(&running, 1) > 1 {
+					atomic.StoreInt32(&overlapped, 1)
+				}
+				a.handled++
+				time.Sleep(100 * time.Microsecond)
+				atomic.AddInt32(&running, -1)
+				return nil, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if overlapped != 0 {
+		t.Fatal("commands of one aggregate overlapped")
+	}
+	var handled int
+	s.Ask(context.Background(), "a", func(ctx context.Context, a *testActorAggregate) (*CommandResult, error) {
+		handled = a.handled
+		return nil, nil
+	})
+	if handled != commands {
+		t.Fatalf("got %d handled commands, want %d", handled, commands)
+	}
+	if loads := persistence.loadsOf("a"); loads != 1 {
+		t.Fatalf("aggregate was loaded %d times, want 1", loads)
+	}
+}
+
+func TestActorSystemPassivatesIdleActors(t *testing.T) {
+	s, persistence := newTestActorSystem(10*time.Millisecond, 0)
+	defer s.Close()
+
+	if _, err := s.Ask(context.Background(), "a", handleNothing); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return s.LiveActors() == 0 })
+	if _, err := s.Ask(context.Background(), "a", handleNothing); err != nil {
+		t.Fatal(err)
+	}
+	if loads := persistence.loadsOf("a"); loads != 2 {
+		t.Fatalf("aggregate was loaded %d times, want 2", loads)
+	}
+}
+
+func TestActorSystemEvictsLeastRecentlyUsedActor(t *testing.T) {
+	s, persistence := newTestActorSystem(0, 2)
+	defer s.Close()
+
+	for _, id := range []string{"a", "b", "a", "c"} {
+		if _, err := s.Ask(context.Background(), id, handleNothing); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if live := s.LiveActors(); live != 2 {
+		t.Fatalf("got %d live actors, want 2", live)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := s.Ask(context.Background(), id, handleNothing); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads := persistence.loadsOf("a"); loads != 1 {
+		t.Fatalf("recently used aggregate was loaded %d times, want 1", loads)
+	}
+	if loads := persistence.loadsOf("b"); loads != 2 {
+		t.Fatalf("least recently used aggregate was loaded %d times, want 2", loads)
+	}
+}
+
+func TestActorSystemAskHonorsCancelWhileAllActorsAreBusy(t *testing.T) {
+	s, _ := newTestActorSystem(0, 1)
+	defer s.Close()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	go s.Ask(context.Background(), "a", func(ctx context.Context, a *testActorAggregate) (*CommandResult, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.Ask(ctx, "b", handleNothing); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if _, err := s.Ask(context.Background(), "b", handleNothing); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestActorSystemInvalidateReloadsAggregate(t *testing.T) {
+	s, persistence := newTestActorSystem(0, 0)
+	defer s.Close()
+
+	if _, err := s.Ask(context.Background(), "a", func(ctx context.Context, a *testActorAggregate) (*CommandResult, error) {
+		a.handled++
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Invalidate(context.Background(), "a", func(ctx context.Context, a *testActorAggregate) error {
+		if a.handled != 1 {
+			t.Errorf("invalidate got %d handled commands, want the cached aggregate", a.handled)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Ask(context.Background(), "a", func(ctx context.Context, a *testActorAggregate) (*CommandResult, error) {
+		if a.handled != 0 {
+			t.Errorf("got %d handled commands after invalidate, want a reloaded aggregate", a.handled)
+		}
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if loads := persistence.loadsOf("a"); loads != 2 {
+		t.Fatalf("aggregate was loaded %d times, want 2", loads)
+	}
+}
+
+func TestActorSystemCloseHandlesPendingMessages(t *testing.T) {
+	s, _ := newTestActorSystem(0, 0)
+
+	const queued = 5
+	started, release := make(chan struct{}), make(chan struct{})
+	errs := make(chan error, queued+1)
+	go func() {
+		_, err := s.Ask(context.Background(), "a", func(ctx context.Context, a *testActorAggregate) (*CommandResult, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+		errs <- err
+	}()
+	<-started
+	var handled int32
+	for i := 0; i < queued; i++ {
+		go func() {
+			_, err := s.Ask(context.Background(), "a", func(ctx context.Context, a *testActorAggregate) (*CommandResult, error) {
+				atomic.AddInt32(&handled, 1)
+				return nil, nil
+			})
+			errs <- err
+		}()
+	}
+	waitFor(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.actors["a"].pending == queued+1
+	})
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned before pending messages were handled")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	<-closed
+
+	for i := 0; i < queued+1; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if handled != queued {
+		t.Fatalf("got %d handled messages, want %d", handled, queued)
+	}
+	if _, err := s.Ask(context.Background(), "a", handleNothing); err != ErrActorSystemClosed {
+		t.Fatalf("got %v, want %v", err, ErrActorSystemClosed)
+	}
+}
@@ -16,6 +16,8 @@ type AggregateContext interface {
 	AppendUncommittedEvent(EventContext)
 	CommitEvent(EventContext)
 	CommittedEvents() []EventContext
+	EventMetadata() EventMetadata
+	SetEventMetadata(EventMetadata)
 	Replay([]*StoredEvent) error
 }
 
@@ -29,22 +31,93 @@ func NewAggregateID() (string, error) {
 	return id.String(), nil
 }
 
+// DeriveAggregateID is aggregate id derived from name, the same name always derives the same id
+func DeriveAggregateID(name string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(name)).String()
+}
+
+// sequencedEvent is event with in-aggregate sequence number
+type sequencedEvent struct {
+	sequence int64
+	event    EventContext
+}
+
+// ApplyFunc is apply event to aggregate state
+type ApplyFunc func(e EventContext) error
+
+// ConvertFunc is stored event to event
+type ConvertFunc func(storedEvent *StoredEvent) (EventContext, error)
+
 // AggregateBase is aggregate
+//
+// Events are kept in raise order and numbered by an in-aggregate sequence,
+// so the order does not depend on GetOccurredOn (wall clock).
+// All committed events are kept unless SetCommittedEventLimit bounds them (e.g. aggregates kept by ActorSystem).
+// Aggregates set their apply and convert functions with SetEventHandler (usually routing by EventRouter),
+// then Raise and Replay are implemented here.
 type AggregateBase struct {
-	aggregateID         string
-	streamVersion       int64
-	uncommittedEventMap map[string]EventContext
-	committedEventMap   map[string]EventContext
+	aggregateID       string
+	streamVersion     int64
+	sequence          int64
+	uncommittedEvents []*sequencedEvent
+	committedEvents   []*sequencedEvent
+	committedLimit    int
+	metadata          EventMetadata
+	apply             ApplyFunc
+	convert           ConvertFunc
 }
 
 // NewAggregateBase is new aggregate base
 func NewAggregateBase(aggregateID string) *AggregateBase {
 	return &AggregateBase{
-		aggregateID:         aggregateID,
-		streamVersion:       int64(0),
-		uncommittedEventMap: make(map[string]EventContext),
-		committedEventMap:   make(map[string]EventContext),
+		aggregateID:   aggregateID,
+		streamVersion: int64(0),
+	}
+}
+
+// SetEventHandler is set apply and convert functions used by Raise and Replay
+func (a *AggregateBase) SetEventHandler(apply ApplyFunc, convert ConvertFunc) {
+	a.apply = apply
+	a.convert = convert
+}
+
+// Raise is apply new event and append it as uncommitted
+func (a *AggregateBase) Raise(e EventContext) error {
+	if a.apply == nil {
+		return errors.New("event handler is not set")
 	}
+	if err := a.apply(e); err != nil {
+		return err
+	}
+	a.AppendUncommittedEvent(e)
+	return nil
+}
+
+// Replay is apply stored events newer than stream version in stream version order (AggregateContext interface)
+func (a *AggregateBase) Replay(storedEvents []*StoredEvent) error {
+	if a.apply == nil || a.convert == nil {
+		return errors.New("event handler is not set")
+	}
+	sorted := make([]*StoredEvent, len(storedEvents))
+	copy(sorted, storedEvents)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].StreamVersion < sorted[j].StreamVersion
+	})
+	for _, storedEvent := range sorted {
+		if storedEvent.StreamVersion <= a.streamVersion {
+			continue
+		}
+		e, err := a.convert(storedEvent)
+		if err != nil {
+			return err
+		}
+		if err := a.apply(e); err != nil {
+			return err
+		}
+		a.CommitEvent(e)
+		a.streamVersion = storedEvent.StreamVersion
+	}
+	return nil
 }
 
 // AggregateID is aggregate id
@@ -62,52 +135,96 @@ func (a *AggregateBase) SetStreamVersion(value int64) {
 	a.streamVersion = value
 }
 
-// UncommittedEvents is get uncommitted events
-func (a *AggregateBase) UncommittedEvents() []EventContext {
-	if a.uncommittedEventMap == nil {
-		a.uncommittedEventMap = make(map[string]EventContext)
-	}
-	results := make([]EventContext, 0, len(a.uncommittedEventMap))
-	for _, event := range a.uncommittedEventMap {
-		results = append(results, event)
+// EventMetadata is metadata stamped on uncommitted events when saved
+func (a *AggregateBase) EventMetadata() EventMetadata {
+	return a.metadata
+}
+
+// SetEventMetadata is set metadata stamped on uncommitted events when saved
+func (a *AggregateBase) SetEventMetadata(value EventMetadata) {
+	a.metadata = value
+}
+
+// SetCommittedEventLimit is keep only the last limit committed events, limit <= 0 keeps all
+func (a *AggregateBase) SetCommittedEventLimit(limit int) {
+	a.committedLimit = limit
+	a.trimCommittedEvents()
+}
+
+// Sequence is last assigned event sequence number
+func (a *AggregateBase) Sequence() int64 {
+	return a.sequence
+}
+
+// EventSequence is sequence number of event, 0 when event is unknown
+func (a *AggregateBase) EventSequence(event EventContext) int64 {
+	for _, events := range [][]*sequencedEvent{a.uncommittedEvents, a.committedEvents} {
+		for _, e := range events {
+			if e.event.GetEventID() == event.GetEventID() {
+				return e.sequence
+			}
+		}
 	}
-	sort.SliceStable(results, func(i, j int) bool {
-		return results[i].GetOccurredOn() < results[j].GetOccurredOn()
-	})
-	return results
+	return 0
 }
 
-// AppendUncommittedEvent is append uncommitted event
+// UncommittedEvents is get uncommitted events in raise order
+func (a *AggregateBase) UncommittedEvents() []EventContext {
+	return eventsOf(a.uncommittedEvents)
+}
+
+// AppendUncommittedEvent is append uncommitted event with next sequence number
 func (a *AggregateBase) AppendUncommittedEvent(event EventContext) {
-	if a.uncommittedEventMap == nil {
-		a.uncommittedEventMap = make(map[string]EventContext)
-	}
-	a.uncommittedEventMap[event.GetEventID()] = event
+	a.sequence++
+	a.uncommittedEvents = append(a.uncommittedEvents, &sequencedEvent{
+		sequence: a.sequence,
+		event:    event,
+	})
 }
 
-// CommittedEvents is get committed events
+// CommittedEvents is get committed events in raise order, only the last ones when a limit is set
 func (a *AggregateBase) CommittedEvents() []EventContext {
-	if a.committedEventMap == nil {
-		a.committedEventMap = make(map[string]EventContext)
-	}
-	results := make([]EventContext, 0, len(a.committedEventMap))
-	for _, event := range a.committedEventMap {
-		results = append(results, event)
+	return eventsOf(a.committedEvents)
+}
+
+// CommitEvent is commit event, event not appended as uncommitted (replayed event) gets next sequence number
+func (a *AggregateBase) CommitEvent(event EventContext) {
+	for i, e := range a.uncommittedEvents {
+		if e.event.GetEventID() == event.GetEventID() {
+			a.uncommittedEvents = append(a.uncommittedEvents[:i], a.uncommittedEvents[i+1:]...)
+			// keep committed events in sequence order even when committed out of raise order
+			j := sort.Search(len(a.committedEvents), func(j int) bool {
+				return a.committedEvents[j].sequence > e.sequence
+			})
+			a.committedEvents = append(a.committedEvents, nil)
+			copy(a.committedEvents[j+1:], a.committedEvents[j:])
+			a.committedEvents[j] = e
+			a.trimCommittedEvents()
+			return
+		}
 	}
-	sort.SliceStable(results, func(i, j int) bool {
-		return results[i].GetOccurredOn() < results[j].GetOccurredOn()
+	a.sequence++
+	a.committedEvents = append(a.committedEvents, &sequencedEvent{
+		sequence: a.sequence,
+		event:    event,
 	})
-	return results
+	a.trimCommittedEvents()
 }
 
-// CommitEvent is commit event
-func (a *AggregateBase) CommitEvent(event EventContext) {
-	if a.uncommittedEventMap == nil {
-		a.uncommittedEventMap = make(map[string]EventContext)
+// trimCommittedEvents is drop the oldest committed events over the limit
+func (a *AggregateBase) trimCommittedEvents() {
+	if a.committedLimit <= 0 || len(a.committedEvents) <= a.committedLimit {
+		return
 	}
-	delete(a.uncommittedEventMap, event.GetEventID())
-	if a.committedEventMap == nil {
-		a.committedEventMap = make(map[string]EventContext)
+	// copy so the dropped events are not kept alive by the backing array
+	a.committedEvents = append([]*sequencedEvent(nil), a.committedEvents[len(a.committedEvents)-a.committedLimit:]...)
+}
+
+// eventsOf is events of sequenced events
+func eventsOf(sequenced []*sequencedEvent) []EventContext {
+	results := make([]EventContext, 0, len(sequenced))
+	for _, e := range sequenced {
+		results = append(results, e.event)
 	}
-	a.committedEventMap[event.GetEventID()] = event
+	return results
 }
@@ -0,0 +1,197 @@
+package common
+
+import (
+	"context"
+	"fmt"
+)
+
+// event metadata headers recording authorization decision of command, for audit
+const (
+	HeaderAuthzPrincipal = "authz-principal"
+	HeaderAuthzAction    = "authz-action"
+	HeaderAuthzRule      = "authz-rule"
+)
+
+// AttributeOwner is resource attribute of owner principal id
+const AttributeOwner = "owner"
+
+// Principal is authenticated caller, carried through request context (WithPrincipal)
+type Principal struct {
+	ID         string
+	Roles      []string
+	Attributes map[string]string
+}
+
+// HasRole is principal has role
+func (p *Principal) HasRole(role string) bool {
+	return containsString(p.Roles, role)
+}
+
+// principalKey is context key of principal
+type principalKey struct{}
+
+// WithPrincipal is context carrying principal
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom is principal of context, nil when anonymous
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// AuthorizationRequest is action on resource requested by principal, Principal is nil when anonymous
+type AuthorizationRequest struct {
+	Principal  *Principal
+	Action     string
+	ResourceID string
+	Attributes map[string]string
+}
+
+// Decision is policy decision, PrincipalID and Action are set by Authorize
+type Decision struct {
+	Allowed     bool
+	Rule        string
+	Reason      string
+	PrincipalID string
+	Action      string
+}
+
+// Record is metadata with decision recorded in headers, UserID defaults to the principal
+func (d *Decision) Record(metadata EventMetadata) EventMetadata {
+	headers := make(map[string]string, len(metadata.Headers)+3)
+	for k, v := range metadata.Headers {
+		headers[k] = v
+	}
+	headers[HeaderAuthzPrincipal] = d.PrincipalID
+	headers[HeaderAuthzAction] = d.Action
+	headers[HeaderAuthzRule] = d.Rule
+	metadata.Headers = headers
+	if metadata.UserID == "" {
+		metadata.UserID = d.PrincipalID
+	}
+	return metadata
+}
+
+// Policy is authorization policy interface
+type Policy interface {
+	Evaluate(ctx context.Context, request *AuthorizationRequest) (*Decision, error)
+}
+
+// ErrForbidden is action denied by policy error
+type ErrForbidden struct {
+	PrincipalID string
+	Action      string
+	ResourceID  string
+	Reason      string
+}
+
+// Error is error message (error interface)
+func (e *ErrForbidden) Error() string {
+	principal := e.PrincipalID
+	if principal == "" {
+		principal = "anonymous"
+	}
+	return fmt.Sprintf("%s is not allowed to %s %s: %s", principal, e.Action, e.ResourceID, e.Reason)
+}
+
+// Authorize is evaluate policy for principal of context, *ErrForbidden when denied
+func Authorize(ctx context.Context, policy Policy, action, resourceID string, attributes map[string]string) (*Decision, error) {
+	request := &AuthorizationRequest{
+		Principal:  PrincipalFrom(ctx),
+		Action:     action,
+		ResourceID: resourceID,
+		Attributes: attributes,
+	}
+	decision, err := policy.Evaluate(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if request.Principal != nil {
+		decision.PrincipalID = request.Principal.ID
+	}
+	decision.Action = action
+	if !decision.Allowed {
+		return decision, &ErrForbidden{
+			PrincipalID: decision.PrincipalID,
+			Action:      action,
+			ResourceID:  resourceID,
+			Reason:      decision.Reason,
+		}
+	}
+	return decision, nil
+}
+
+// PolicyRule is rule allowing actions to principals having one of roles when condition holds
+//
+// Empty Actions is any action, empty Roles is any role and nil Condition always holds.
+type PolicyRule struct {
+	Name      string
+	Actions   []string
+	Roles     []string
+	Condition func(request *AuthorizationRequest) bool
+}
+
+// matches is rule allows request
+func (r *PolicyRule) matches(request *AuthorizationRequest) bool {
+	if len(r.Actions) > 0 && !containsString(r.Actions, request.Action) {
+		return false
+	}
+	if len(r.Roles) > 0 {
+		matched := false
+		for _, role := range r.Roles {
+			if request.Principal.HasRole(role) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return r.Condition == nil || r.Condition(request)
+}
+
+// PolicyEngine is role and attribute based policy, allowing request matched by any rule
+//
+// Requests without principal and requests matched by no rule are denied.
+type PolicyEngine struct {
+	rules []*PolicyRule
+}
+
+// NewPolicyEngine is new policy engine
+func NewPolicyEngine(rules ...*PolicyRule) *PolicyEngine {
+	return &PolicyEngine{
+		rules: rules,
+	}
+}
+
+// Evaluate is evaluate rules in order (Policy interface)
+func (e *PolicyEngine) Evaluate(ctx context.Context, request *AuthorizationRequest) (*Decision, error) {
+	if request.Principal == nil {
+		return &Decision{Reason: "not authenticated"}, nil
+	}
+	for _, rule := range e.rules {
+		if rule.matches(request) {
+			return &Decision{Allowed: true, Rule: rule.Name}, nil
+		}
+	}
+	return &Decision{Reason: "no rule allows"}, nil
+}
+
+// IsOwner is condition that principal is owner of resource (AttributeOwner)
+func IsOwner(request *AuthorizationRequest) bool {
+	owner := request.Attributes[AttributeOwner]
+	return owner != "" && request.Principal != nil && owner == request.Principal.ID
+}
+
+// containsString is values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
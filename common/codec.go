@@ -0,0 +1,233 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// compressions
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+)
+
+// DefaultCompressThreshold is default payload size compressed from
+const DefaultCompressThreshold = 1024
+
+// Keyring is encryption key ring interface
+//
+// Events record id of key they were encrypted with, so rotating the current key
+// never requires rewriting history as long as retired keys stay in the ring.
+type Keyring interface {
+	CurrentKey(ctx context.Context) (keyID string, key []byte, err error)
+	KeyByID(ctx context.Context, keyID string) ([]byte, error)
+}
+
+// InMemoryKeyring is in memory key ring
+type InMemoryKeyring struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewInMemoryKeyring is new in memory key ring
+func NewInMemoryKeyring() *InMemoryKeyring {
+	return &InMemoryKeyring{
+		keys: make(map[string][]byte),
+	}
+}
+
+// Rotate is add key and make it current, key must be 16, 24 or 32 bytes (AES-128, 192 or 256)
+func (r *InMemoryKeyring) Rotate(keyID string, key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return errors.Errorf("invalid key size %d", len(key))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keys[keyID] = append([]byte(nil), key...)
+	r.current = keyID
+	return nil
+}
+
+// RotateRandom is add random 256 bit key and make it current
+func (r *InMemoryKeyring) RotateRandom(keyID string) error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return errors.Wrap(err, "鍵の生成に失敗しました")
+	}
+	return r.Rotate(keyID, key)
+}
+
+// CurrentKey is key to encrypt with (Keyring interface)
+func (r *InMemoryKeyring) CurrentKey(ctx context.Context) (string, []byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.current == "" {
+		return "", nil, ErrKeyNotFound
+	}
+	return r.current, r.keys[r.current], nil
+}
+
+// KeyByID is key to decrypt with (Keyring interface)
+func (r *InMemoryKeyring) KeyByID(ctx context.Context, keyID string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, ok := r.keys[keyID]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// PayloadCodec is compression and encryption at rest of stored event payloads and snapshots
+//
+// Payloads of at least compressThreshold bytes are gzipped, then all payloads are sealed with AES-GCM
+// when a key ring is set. Compression and key id are recorded on each stored event (and snapshot),
+// so payloads written with other settings are decoded as well.
+type PayloadCodec struct {
+	compressThreshold int
+	keyring           Keyring
+}
+
+// NewPayloadCodec is new payload codec, negative compressThreshold disables compression and nil keyring disables encryption
+func NewPayloadCodec(compressThreshold int, keyring Keyring) *PayloadCodec {
+	return &PayloadCodec{
+		compressThreshold: compressThreshold,
+		keyring:           keyring,
+	}
+}
+
+// encode is compress and encrypt payload of stored event
+func (c *PayloadCodec) encode(ctx context.Context, storedEvent *StoredEvent) error {
+	d, compression, keyID, err := c.seal(ctx, storedEvent.Data, payloadAAD(storedEvent))
+	if err != nil {
+		return err
+	}
+	storedEvent.Data = d
+	storedEvent.Compression = compression
+	storedEvent.KeyID = keyID
+	return nil
+}
+
+// encodeSnapshot is compress and encrypt data of snapshot
+func (c *PayloadCodec) encodeSnapshot(ctx context.Context, snapshot *Snapshot) error {
+	d, compression, keyID, err := c.seal(ctx, snapshot.Data, snapshotAAD(snapshot))
+	if err != nil {
+		return err
+	}
+	snapshot.Data = d
+	snapshot.Compression = compression
+	snapshot.KeyID = keyID
+	return nil
+}
+
+// seal is compress and encrypt data, and return it with its compression and key id
+func (c *PayloadCodec) seal(ctx context.Context, data, aad []byte) ([]byte, string, string, error) {
+	compression := CompressionNone
+	if c.compressThreshold >= 0 && len(data) >= c.compressThreshold {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, "", "", err
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", "", err
+		}
+		data = buf.Bytes()
+		compression = CompressionGzip
+	}
+	if c.keyring == nil {
+		return data, compression, "", nil
+	}
+	keyID, key, err := c.keyring.CurrentKey(ctx)
+	if err != nil {
+		return nil, "", "", err
+	}
+	d, err := sealAESGCM(key, data, aad)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return d, compression, keyID, nil
+}
+
+// decodePayloads is decrypt and decompress payloads of stored events, c may be nil when no event is encoded
+func decodePayloads(ctx context.Context, c *PayloadCodec, storedEvents []*StoredEvent) error {
+	for _, storedEvent := range storedEvents {
+		d, err := openPayload(ctx, c, storedEvent.Data, storedEvent.Compression, storedEvent.KeyID, payloadAAD(storedEvent))
+		if err != nil {
+			return errors.Wrapf(err, "イベント%sの復元に失敗しました", storedEvent.EventID)
+		}
+		storedEvent.Data = d
+		storedEvent.Compression = CompressionNone
+		storedEvent.KeyID = ""
+	}
+	return nil
+}
+
+// decodeSnapshot is decrypt and decompress data of snapshot, c may be nil when snapshot is not encoded
+func decodeSnapshot(ctx context.Context, c *PayloadCodec, snapshot *Snapshot) error {
+	d, err := openPayload(ctx, c, snapshot.Data, snapshot.Compression, snapshot.KeyID, snapshotAAD(snapshot))
+	if err != nil {
+		return errors.Wrapf(err, "%sのスナップショットの復元に失敗しました", snapshot.AggregateID)
+	}
+	snapshot.Data = d
+	snapshot.Compression = CompressionNone
+	snapshot.KeyID = ""
+	return nil
+}
+
+// openPayload is decrypt and decompress data sealed with compression and key id
+func openPayload(ctx context.Context, c *PayloadCodec, data []byte, compression, keyID string, aad []byte) ([]byte, error) {
+	if keyID != "" {
+		if c == nil || c.keyring == nil {
+			return nil, errors.New("payload is encrypted but key ring is not set")
+		}
+		key, err := c.keyring.KeyByID(ctx, keyID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "鍵%sの取得に失敗しました", keyID)
+		}
+		d, err := openAESGCM(key, data, aad)
+		if err != nil {
+			return nil, err
+		}
+		data = d
+	}
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "展開に失敗しました")
+		}
+		d, err := io.ReadAll(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "展開に失敗しました")
+		}
+		return d, nil
+	default:
+		return nil, errors.Errorf("unknown compression %s", compression)
+	}
+}
+
+// payloadAAD is additional data binding encrypted payload to its event
+func payloadAAD(storedEvent *StoredEvent) []byte {
+	return []byte(storedEvent.AggregateID + "/" + storedEvent.EventID)
+}
+
+// snapshotAAD is additional data binding encrypted snapshot to its aggregate and stream version
+func snapshotAAD(snapshot *Snapshot) []byte {
+	return []byte(fmt.Sprintf("%s/snapshot/%d", snapshot.AggregateID, snapshot.StreamVersion))
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func newTestKeyring(t *testing.T, keyIDs ...string) *InMemoryKeyring {
+	t.Helper()
+	keyring := NewInMemoryKeyring()
+	for _, keyID := range keyIDs {
+		if err := keyring.RotateRandom(keyID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keyring
+}
+
+func newTestStoredEvent(eventID string, data []byte) *StoredEvent {
+	return &StoredEvent{
+		EventID:     eventID,
+		AggregateID: "a",
+		EventType:   "TestEvent",
+		ContentType: ContentTypeJSON,
+		Data:        append([]byte(nil), data...),
+	}
+}
+
+func TestPayloadCodecRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	c := NewPayloadCodec(16, newTestKeyring(t, "k1"))
+
+	small, large := []byte(`{"Value":"x"}`), []byte(`{"Value":"`+strings.Repeat("x", 100)+`"}`)
+	storedEvents := []*StoredEvent{newTestStoredEvent("e1", small), newTestStoredEvent("e2", large)}
+	for _, storedEvent := range storedEvents {
+		if err := c.encode(ctx, storedEvent); err != nil {
+			t.Fatal(err)
+		}
+		if storedEvent.KeyID != "k1" || bytes.Contains(storedEvent.Data, []byte("Value")) {
+			t.Fatalf("payload of %s is not encrypted", storedEvent.EventID)
+		}
+	}
+	snapshot := &Snapshot{AggregateID: "a", StreamVersion: 2, Data: large}
+	if err := c.encodeSnapshot(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := decodePayloads(ctx, c, storedEvents); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storedEvents[0].Data, small) || !bytes.Equal(storedEvents[1].Data, large) {
+		t.Fatalf("got %s and %s", storedEvents[0].Data, storedEvents[1].Data)
+	}
+	if storedEvents[1].Compression != CompressionNone || storedEvents[1].KeyID != "" {
+		t.Fatal("decoded event keeps codec settings")
+	}
+	if err := decodeSnapshot(ctx, c, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(snapshot.Data, large) {
+		t.Fatalf("got %s, want %s", snapshot.Data, large)
+	}
+}
+
+func TestPayloadCodecDecodesAcrossKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	keyring := newTestKeyring(t, "k1")
+	c := NewPayloadCodec(-1, keyring)
+
+	data := []byte(`{"Value":"test"}`)
+	old := newTestStoredEvent("e1", data)
+	if err := c.encode(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.RotateRandom("k2"); err != nil {
+		t.Fatal(err)
+	}
+	current := newTestStoredEvent("e2", data)
+	if err := c.encode(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+	if old.KeyID != "k1" || current.KeyID != "k2" {
+		t.Fatalf("got key ids %s and %s, want k1 and k2", old.KeyID, current.KeyID)
+	}
+
+	// a ring without the retired key cannot read the old event
+	retired := NewPayloadCodec(-1, NewInMemoryKeyring())
+	if err := decodePayloads(ctx, retired, []*StoredEvent{{EventID: old.EventID, AggregateID: old.AggregateID, KeyID: old.KeyID, Data: old.Data}}); errors.Cause(err) != ErrKeyNotFound {
+		t.Fatalf("got %v, want %v", err, ErrKeyNotFound)
+	}
+
+	if err := decodePayloads(ctx, c, []*StoredEvent{old, current}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(old.Data, data) || !bytes.Equal(current.Data, data) {
+		t.Fatalf("got %s and %s, want %s", old.Data, current.Data, data)
+	}
+}
+
+func TestPayloadCodecCompressesFromThreshold(t *testing.T) {
+	ctx := context.Background()
+	data := []byte(strings.Repeat("x", 64))
+
+	for _, tc := range []struct {
+		threshold int
+		size      int
+		want      string
+	}{
+		{64, 63, CompressionNone},
+		{64, 64, CompressionGzip},
+		{0, 1, CompressionGzip},
+		{-1, 64, CompressionNone},
+	} {
+		c := NewPayloadCodec(tc.threshold, nil)
+		storedEvent := newTestStoredEvent("e1", data[:tc.size])
+		if err := c.encode(ctx, storedEvent); err != nil {
+			t.Fatal(err)
+		}
+		if storedEvent.Compression != tc.want || storedEvent.KeyID != "" {
+			t.Fatalf("threshold %d and size %d got compression %q, want %q", tc.threshold, tc.size, storedEvent.Compression, tc.want)
+		}
+		if err := decodePayloads(ctx, c, []*StoredEvent{storedEvent}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(storedEvent.Data, data[:tc.size]) {
+			t.Fatalf("threshold %d and size %d got %s", tc.threshold, tc.size, storedEvent.Data)
+		}
+	}
+}
+
+func TestPayloadCodecRejectsMismatchedAAD(t *testing.T) {
+	ctx := context.Background()
+	c := NewPayloadCodec(-1, newTestKeyring(t, "k1"))
+
+	storedEvent := newTestStoredEvent("e1", []byte(`{"Value":"test"}`))
+	if err := c.encode(ctx, storedEvent); err != nil {
+		t.Fatal(err)
+	}
+	// the payload of e1 copied to another event must not decrypt
+	moved := *storedEvent
+	moved.EventID = "e2"
+	if err := decodePayloads(ctx, c, []*StoredEvent{&moved}); err == nil {
+		t.Fatal("payload decoded under another event id")
+	}
+	moved = *storedEvent
+	moved.AggregateID = "b"
+	if err := decodePayloads(ctx, c, []*StoredEvent{&moved}); err == nil {
+		t.Fatal("payload decoded under another aggregate id")
+	}
+
+	snapshot := &Snapshot{AggregateID: "a", StreamVersion: 2, Data: []byte(`{"Value":"test"}`)}
+	if err := c.encodeSnapshot(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	snapshot.StreamVersion = 3
+	if err := decodeSnapshot(ctx, c, snapshot); err == nil {
+		t.Fatal("snapshot decoded under another stream version")
+	}
+}
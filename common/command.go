@@ -0,0 +1,121 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// NewCommandID is new command id
+func NewCommandID() (string, error) {
+	id, err := uuid.NewUUID()
+	if err != nil {
+		return "", errors.Wrap(err, "IDの生成に失敗しました")
+	}
+
+	return id.String(), nil
+}
+
+// CommandResult is result of command handling
+//
+// StreamVersion is version after the command, clients may wait for read models to reach it.
+// EventIDs are ids of events appended by the command in stream order.
+type CommandResult struct {
+	AggregateID   string
+	StreamVersion int64
+	EventIDs      []string
+}
+
+// CausationDB is database finding stored events by the command (or event) which caused them
+type CausationDB interface {
+	// GetByCausationID is get stored events of aggregate with causation id in stream order
+	GetByCausationID(ctx context.Context, aggregateID, causationID string) ([]*StoredEvent, error)
+}
+
+// CausationPruner is database forgetting causations, so GetByCausationID does not find them
+type CausationPruner interface {
+	// PruneCausations is forget causations of commands occurred before (unix nano)
+	PruneCausations(ctx context.Context, before int64) error
+}
+
+// ProcessedCommandStore is processed command store interface
+//
+// Commands are looked up per aggregate, so a duplicate submission of the same command id
+// to the same aggregate returns the original result.
+type ProcessedCommandStore interface {
+	// FindProcessed is find result of command processed on aggregate, nil when not processed
+	FindProcessed(ctx context.Context, aggregateID, commandID string) (*CommandResult, error)
+}
+
+// EventProcessedCommandStore is processed command store on events
+//
+// A command is processed when its aggregate has events caused by it (EventMetadata.CausationID is the command id).
+// Events are committed atomically, so there is no window where events are saved but the command is not recorded,
+// and the record is as durable as the event database.
+// Only commands with events are recorded, a rejected command or one without events is handled again.
+// Commands with events older than retention are forgotten, and pruned from a CausationPruner at most once per retention.
+type EventProcessedCommandStore struct {
+	mu        sync.Mutex
+	db        CausationDB
+	retention time.Duration
+	pruned    time.Time
+}
+
+// NewEventProcessedCommandStore is new event processed command store, retention 0 keeps commands forever
+func NewEventProcessedCommandStore(db CausationDB, retention time.Duration) *EventProcessedCommandStore {
+	return &EventProcessedCommandStore{
+		db:        db,
+		retention: retention,
+	}
+}
+
+// FindProcessed is find result of command processed on aggregate (ProcessedCommandStore interface)
+func (s *EventProcessedCommandStore) FindProcessed(ctx context.Context, aggregateID, commandID string) (*CommandResult, error) {
+	if err := s.prune(ctx); err != nil {
+		return nil, err
+	}
+	storedEvents, err := s.db.GetByCausationID(ctx, aggregateID, commandID)
+	if err != nil {
+		return nil, errors.Wrap(err, "処理済みコマンドの取得に失敗しました")
+	}
+	if len(storedEvents) == 0 {
+		return nil, nil
+	}
+	last := storedEvents[len(storedEvents)-1]
+	if s.retention > 0 && time.Since(time.Unix(0, last.OccurredOn)) > s.retention {
+		return nil, nil
+	}
+	eventIDs := make([]string, 0, len(storedEvents))
+	for _, storedEvent := range storedEvents {
+		eventIDs = append(eventIDs, storedEvent.EventID)
+	}
+	return &CommandResult{
+		AggregateID:   aggregateID,
+		StreamVersion: last.StreamVersion,
+		EventIDs:      eventIDs,
+	}, nil
+}
+
+// prune is prune causations older than retention when a retention has passed since the last prune
+func (s *EventProcessedCommandStore) prune(ctx context.Context) error {
+	pruner, ok := s.db.(CausationPruner)
+	if !ok || s.retention <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.pruned) < s.retention {
+		return nil
+	}
+	if err := pruner.PruneCausations(ctx, now.Add(-s.retention).UnixNano()); err != nil {
+		return errors.Wrap(err, "処理済みコマンドの削除に失敗しました")
+	}
+	s.pruned = now
+	return nil
+}
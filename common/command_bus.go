@@ -0,0 +1,168 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrUnknownCommand is no handler registered for command error
+type ErrUnknownCommand struct {
+	CommandType string
+}
+
+// Error is error message (error interface)
+func (e *ErrUnknownCommand) Error() string {
+	return fmt.Sprintf("unknown command %s", e.CommandType)
+}
+
+// CommandHandler is command handler
+type CommandHandler func(ctx context.Context, command interface{}) (*CommandResult, error)
+
+// CommandMiddleware is wrap command handler with cross-cutting behavior
+type CommandMiddleware func(next CommandHandler) CommandHandler
+
+// CommandBus is dispatcher of commands to handlers registered per command type
+//
+// Middlewares are applied in registration order, the first one is outermost.
+type CommandBus struct {
+	mu          sync.RWMutex
+	handlers    map[reflect.Type]CommandHandler
+	middlewares []CommandMiddleware
+}
+
+// NewCommandBus is new command bus
+func NewCommandBus() *CommandBus {
+	return &CommandBus{
+		handlers: make(map[reflect.Type]CommandHandler),
+	}
+}
+
+// Register is register handler of command type C, panic when C is already registered
+func Register[C any](b *CommandBus, handler func(ctx context.Context, command C) (*CommandResult, error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := reflect.TypeOf((*C)(nil)).Elem()
+	if _, ok := b.handlers[t]; ok {
+		panic(fmt.Sprintf("command %s is already registered", t))
+	}
+	b.handlers[t] = func(ctx context.Context, command interface{}) (*CommandResult, error) {
+		return handler(ctx, command.(C))
+	}
+}
+
+// Use is append middlewares
+func (b *CommandBus) Use(middlewares ...CommandMiddleware) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.middlewares = append(b.middlewares, middlewares...)
+}
+
+// Dispatch is handle command by registered handler through middlewares, *ErrUnknownCommand when not registered
+func (b *CommandBus) Dispatch(ctx context.Context, command interface{}) (*CommandResult, error) {
+	b.mu.RLock()
+	handler, ok := b.handlers[reflect.TypeOf(command)]
+	middlewares := b.middlewares
+	b.mu.RUnlock()
+
+	if !ok {
+		return nil, &ErrUnknownCommand{CommandType: CommandTypeOf(command)}
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler(ctx, command)
+}
+
+// CommandTypeOf is type name of command, without pointer
+func CommandTypeOf(command interface{}) string {
+	t := reflect.TypeOf(command)
+	if t == nil {
+		return "<nil>"
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// LoggingMiddleware is log each command with its result and duration
+func LoggingMiddleware(logger *zap.SugaredLogger) CommandMiddleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, command interface{}) (*CommandResult, error) {
+			start := time.Now()
+			result, err := next(ctx, command)
+			if err != nil {
+				logger.Warnw("command failed", "command", CommandTypeOf(command), "duration", time.Since(start), "error", err)
+				return result, err
+			}
+			logger.Infow("command handled", "command", CommandTypeOf(command), "duration", time.Since(start), "result", result)
+			return result, nil
+		}
+	}
+}
+
+// CommandMetrics is command metrics recorder interface
+type CommandMetrics interface {
+	ObserveCommand(commandType string, duration time.Duration, err error)
+}
+
+// MetricsMiddleware is record duration and outcome of each command
+func MetricsMiddleware(metrics CommandMetrics) CommandMiddleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, command interface{}) (*CommandResult, error) {
+			start := time.Now()
+			result, err := next(ctx, command)
+			metrics.ObserveCommand(CommandTypeOf(command), time.Since(start), err)
+			return result, err
+		}
+	}
+}
+
+// CommandStats is stats of one command type
+type CommandStats struct {
+	Count         int64
+	Errors        int64
+	TotalDuration time.Duration
+}
+
+// InMemoryCommandMetrics is in memory command metrics
+type InMemoryCommandMetrics struct {
+	mu    sync.Mutex
+	stats map[string]CommandStats
+}
+
+// NewInMemoryCommandMetrics is new in memory command metrics
+func NewInMemoryCommandMetrics() *InMemoryCommandMetrics {
+	return &InMemoryCommandMetrics{
+		stats: make(map[string]CommandStats),
+	}
+}
+
+// ObserveCommand is record command (CommandMetrics interface)
+func (m *InMemoryCommandMetrics) ObserveCommand(commandType string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.stats[commandType]
+	s.Count++
+	if err != nil {
+		s.Errors++
+	}
+	s.TotalDuration += duration
+	m.stats[commandType] = s
+}
+
+// Stats is stats of command type
+func (m *InMemoryCommandMetrics) Stats(commandType string) CommandStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.stats[commandType]
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy is retry policy of command on concurrency conflict
+//
+// Delay doubles from InitialDelay up to MaxDelay and is jittered to half to full of it,
+// so competing writers do not retry in lockstep.
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// NoRetry is policy never retrying, for commands which must not be re-decided on fresh state
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// DefaultRetryPolicy is default retry policy
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  5,
+		InitialDelay: 10 * time.Millisecond,
+		MaxDelay:     500 * time.Millisecond,
+	}
+}
+
+// ErrConflictRetriesExhausted is command still conflicted after all attempts error
+type ErrConflictRetriesExhausted struct {
+	CommandType string
+	Attempts    int
+	Conflict    *ErrConcurrencyConflict
+}
+
+// Error is error message (error interface)
+func (e *ErrConflictRetriesExhausted) Error() string {
+	return fmt.Sprintf("command %s conflicted %d times: %v", e.CommandType, e.Attempts, e.Conflict)
+}
+
+// Unwrap is last conflict
+func (e *ErrConflictRetriesExhausted) Unwrap() error {
+	return e.Conflict
+}
+
+// RetryOnConflictMiddleware is re-run command on concurrency conflict with policy of its command type
+//
+// A retry decides against fresh state: Repository loads the aggregate on every call,
+// and ActorSystem drops the aggregate left with uncommitted events by the conflicted save.
+// Policies are keyed by command type (CommandTypeOf), others use defaultPolicy.
+// Conflicts are found through wrapped errors (errors.As).
+func RetryOnConflictMiddleware(defaultPolicy RetryPolicy, policies map[string]RetryPolicy) CommandMiddleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, command interface{}) (*CommandResult, error) {
+			commandType := CommandTypeOf(command)
+			policy, ok := policies[commandType]
+			if !ok {
+				policy = defaultPolicy
+			}
+			delay := policy.InitialDelay
+			for attempt := 1; ; attempt++ {
+				result, err := next(ctx, command)
+				var conflict *ErrConcurrencyConflict
+				if !errors.As(err, &conflict) {
+					return result, err
+				}
+				if attempt >= policy.MaxAttempts {
+					return nil, &ErrConflictRetriesExhausted{
+						CommandType: commandType,
+						Attempts:    attempt,
+						Conflict:    conflict,
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(jitter(delay)):
+				}
+				delay *= 2
+				if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+					delay = policy.MaxDelay
+				}
+			}
+		}
+	}
+}
+
+// jitter is random duration of half to full of d
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// validation error codes
+const (
+	ValidationCodeRequired = "required"
+	ValidationCodeTooLong  = "too_long"
+	ValidationCodeInvalid  = "invalid"
+)
+
+// FieldError is validation error of one command field
+type FieldError struct {
+	Path    string
+	Code    string
+	Message string
+}
+
+// ErrValidation is command validation error, with every field error of the command
+type ErrValidation struct {
+	CommandType string
+	Errors      []*FieldError
+}
+
+// Error is error message (error interface)
+func (e *ErrValidation) Error() string {
+	fields := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		fields = append(fields, fmt.Sprintf("%s %s", fe.Path, fe.Message))
+	}
+	return fmt.Sprintf("invalid command %s: %s", e.CommandType, strings.Join(fields, ", "))
+}
+
+// ValidationRule is check command, nil when valid
+type ValidationRule[C any] func(command C) []*FieldError
+
+// Required is rule that string field at path is not blank
+func Required[C any](path string, value func(command C) string) ValidationRule[C] {
+	return func(command C) []*FieldError {
+		if strings.TrimSpace(value(command)) == "" {
+			return []*FieldError{{Path: path, Code: ValidationCodeRequired, Message: "must not be blank"}}
+		}
+		return nil
+	}
+}
+
+// MaxLength is rule that string field at path has at most max characters
+func MaxLength[C any](path string, max int, value func(command C) string) ValidationRule[C] {
+	return func(command C) []*FieldError {
+		if utf8.RuneCountInString(value(command)) > max {
+			return []*FieldError{{Path: path, Code: ValidationCodeTooLong, Message: fmt.Sprintf("must be at most %d characters", max)}}
+		}
+		return nil
+	}
+}
+
+// Check is rule that field at path satisfies valid, failing with code and message
+func Check[C any](path, code, message string, valid func(command C) bool) ValidationRule[C] {
+	return func(command C) []*FieldError {
+		if !valid(command) {
+			return []*FieldError{{Path: path, Code: code, Message: message}}
+		}
+		return nil
+	}
+}
+
+// CommandValidator is validation rules per command type
+//
+// All rules of the command run, so ErrValidation reports every invalid field at once.
+type CommandValidator struct {
+	mu    sync.RWMutex
+	rules map[reflect.Type][]func(command interface{}) []*FieldError
+}
+
+// NewCommandValidator is new command validator
+func NewCommandValidator() *CommandValidator {
+	return &CommandValidator{
+		rules: make(map[reflect.Type][]func(command interface{}) []*FieldError),
+	}
+}
+
+// AddRules is add rules of command type C
+func AddRules[C any](v *CommandValidator, rules ...ValidationRule[C]) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	t := reflect.TypeOf((*C)(nil)).Elem()
+	for _, rule := range rules {
+		rule := rule
+		v.rules[t] = append(v.rules[t], func(command interface{}) []*FieldError {
+			return rule(command.(C))
+		})
+	}
+}
+
+// Validate is run rules of command, *ErrValidation when any field is invalid
+func (v *CommandValidator) Validate(command interface{}) error {
+	v.mu.RLock()
+	rules := v.rules[reflect.TypeOf(command)]
+	v.mu.RUnlock()
+
+	var errs []*FieldError
+	for _, rule := range rules {
+		errs = append(errs, rule(command)...)
+	}
+	if len(errs) > 0 {
+		return &ErrValidation{
+			CommandType: CommandTypeOf(command),
+			Errors:      errs,
+		}
+	}
+	return nil
+}
+
+// ValidationMiddleware is reject invalid command before handling it
+func ValidationMiddleware(v *CommandValidator) CommandMiddleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, command interface{}) (*CommandResult, error) {
+			if err := v.Validate(command); err != nil {
+				return nil, err
+			}
+			return next(ctx, command)
+		}
+	}
+}
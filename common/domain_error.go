@@ -0,0 +1,23 @@
+package common
+
+// DomainError is business rule violation error
+//
+// Domain errors are declared once as sentinels and compared by identity (errors.Is),
+// Code is stable identifier for mapping to user-facing responses.
+type DomainError struct {
+	Code    string
+	Message string
+}
+
+// NewDomainError is new domain error
+func NewDomainError(code, message string) *DomainError {
+	return &DomainError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Error is error message (error interface)
+func (e *DomainError) Error() string {
+	return e.Message
+}
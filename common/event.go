@@ -12,6 +12,29 @@ type EventContext interface {
 	GetOccurredOn() int64
 }
 
+// EventMetadata is metadata envelope of event
+//
+// CorrelationID is shared by everything caused by one request, CausationID is id of command (or event) which caused the event.
+type EventMetadata struct {
+	CorrelationID string
+	CausationID   string
+	UserID        string
+	Headers       map[string]string
+}
+
+// SchemaVersionContext is event with payload schema version interface
+type SchemaVersionContext interface {
+	GetSchemaVersion() int
+}
+
+// SchemaVersionOf is payload schema version of event, 1 when not versioned
+func SchemaVersionOf(e EventContext) int {
+	if v, ok := e.(SchemaVersionContext); ok {
+		return v.GetSchemaVersion()
+	}
+	return 1
+}
+
 // NewEventID is new event id
 func NewEventID() (string, error) {
 	id, err := uuid.NewUUID()
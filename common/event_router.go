@@ -0,0 +1,63 @@
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ErrUnhandledEvent is no handler registered for event error
+type ErrUnhandledEvent struct {
+	EventType string
+}
+
+// Error is error message (error interface)
+func (e *ErrUnhandledEvent) Error() string {
+	return fmt.Sprintf("no handler for event %s", e.EventType)
+}
+
+// EventRouter is apply handlers of events to target T by event type
+//
+// Routers are built once (e.g. in a package variable) with On and checked with MustHandle,
+// so a missing handler fails at construction instead of when the event is raised.
+type EventRouter[T any] struct {
+	handlers map[reflect.Type]func(T, EventContext)
+}
+
+// NewEventRouter is new event router
+func NewEventRouter[T any]() *EventRouter[T] {
+	return &EventRouter[T]{
+		handlers: make(map[reflect.Type]func(T, EventContext)),
+	}
+}
+
+// On is register apply handler of event type E
+func On[T any, E EventContext](r *EventRouter[T], handler func(T, E)) {
+	r.handlers[reflect.TypeOf((*E)(nil)).Elem()] = func(target T, e EventContext) {
+		handler(target, e.(E))
+	}
+}
+
+// MustHandle is panic unless every prototype event has a handler, return router for chaining
+func (r *EventRouter[T]) MustHandle(prototypes ...EventContext) *EventRouter[T] {
+	missing := make([]string, 0)
+	for _, e := range prototypes {
+		if _, ok := r.handlers[reflect.TypeOf(e)]; !ok {
+			missing = append(missing, fmt.Sprintf("%T", e))
+		}
+	}
+	if len(missing) > 0 {
+		panic(fmt.Sprintf("no handler for %s", strings.Join(missing, ", ")))
+	}
+	return r
+}
+
+// Route is apply event to target, *ErrUnhandledEvent when no handler registered
+func (r *EventRouter[T]) Route(target T, e EventContext) error {
+	handler, ok := r.handlers[reflect.TypeOf(e)]
+	if !ok {
+		return &ErrUnhandledEvent{EventType: e.GetEventType()}
+	}
+	handler(target, e)
+	return nil
+}
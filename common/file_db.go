@@ -0,0 +1,598 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// DefaultSegmentSize is default max size of segment file
+const DefaultSegmentSize int64 = 64 << 20
+
+const (
+	segmentPrefix     = "segment-"
+	segmentSuffix     = ".log"
+	recordHeaderSize  = 8
+	maxRecordDataSize = 1 << 30
+)
+
+// fileRecordLocation is location of record in segment files
+type fileRecordLocation struct {
+	segment       int
+	offset        int64
+	size          int64
+	firstPosition int64
+	lastPosition  int64
+	occurredOn    int64
+}
+
+// causationKey is key of records by the command (or event) which caused them
+type causationKey struct {
+	aggregateID string
+	causationID string
+}
+
+// fileRecord is one commit in segment file
+//
+// Records of stored events and outbox entries are written by Append, records of dispatched outbox ids by MarkDispatched.
+// Position is last global position of events removed by DeleteStream, kept so positions are never reused.
+type fileRecord struct {
+	Events     []*StoredEvent `json:",omitempty"`
+	Outbox     []*OutboxEntry `json:",omitempty"`
+	Dispatched []string       `json:",omitempty"`
+	Position   int64          `json:",omitempty"`
+}
+
+// FileDB is durable database on segmented append-only log files
+//
+// Each commit is written as one record (length, crc32 and json of fileRecord) and fsynced,
+// so a commit is either fully visible or not at all after a crash.
+type FileDB struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+	segments    map[int]*os.File
+	active      int
+	activeSize  int64
+	index       map[string][]fileRecordLocation
+	causations  map[causationKey][]fileRecordLocation
+	records     []fileRecordLocation
+	versions    map[string]int64
+	position    int64
+	outbox      []*OutboxEntry
+	notifier    commitNotifier
+	logger      *zap.SugaredLogger
+}
+
+// NewFileDB is open file db on dir, and recover torn final write
+func NewFileDB(dir string, segmentSize int64, logger *zap.SugaredLogger) (*FileDB, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "ディレクトリの作成に失敗しました")
+	}
+	db := &FileDB{
+		dir:         dir,
+		segmentSize: segmentSize,
+		segments:    make(map[int]*os.File),
+		index:       make(map[string][]fileRecordLocation),
+		causations:  make(map[causationKey][]fileRecordLocation),
+		versions:    make(map[string]int64),
+		logger:      logger,
+	}
+	if err := db.open(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// open is open segment files and build index
+func (db *FileDB) open() error {
+	ids, err := db.segmentIDs()
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return db.createSegment(1)
+	}
+	for i, id := range ids {
+		f, err := os.OpenFile(db.segmentPath(id), os.O_RDWR, 0644)
+		if err != nil {
+			return errors.Wrap(err, "セグメントのオープンに失敗しました")
+		}
+		db.segments[id] = f
+		size, err := db.scanSegment(id, f)
+		if err != nil {
+			if i != len(ids)-1 {
+				return errors.Wrapf(err, "セグメント%dが破損しています", id)
+			}
+			db.logger.Warnw("truncate torn write", "segment", id, "offset", size, "error", err)
+			if err := f.Truncate(size); err != nil {
+				return errors.Wrap(err, "セグメントの切り詰めに失敗しました")
+			}
+			if err := f.Sync(); err != nil {
+				return errors.Wrap(err, "セグメントの同期に失敗しました")
+			}
+		}
+		db.active = id
+		db.activeSize = size
+	}
+	return nil
+}
+
+// scanSegment is index records in segment, and return valid size
+func (db *FileDB) scanSegment(id int, f *os.File) (int64, error) {
+	offset := int64(0)
+	for {
+		rec, size, err := readRecord(f, offset)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		db.indexRecord(fileRecordLocation{segment: id, offset: offset, size: size}, rec)
+		offset += size
+	}
+}
+
+// indexRecord is add record to index
+func (db *FileDB) indexRecord(loc fileRecordLocation, rec *fileRecord) {
+	db.outbox = append(db.outbox, rec.Outbox...)
+	if len(rec.Dispatched) > 0 {
+		dispatched := make(map[string]bool, len(rec.Dispatched))
+		for _, id := range rec.Dispatched {
+			dispatched[id] = true
+		}
+		pending := db.outbox[:0]
+		for _, entry := range db.outbox {
+			if !dispatched[entry.ID] {
+				pending = append(pending, entry)
+			}
+		}
+		db.outbox = pending
+	}
+	if rec.Position > db.position {
+		db.position = rec.Position
+	}
+	storedEvents := rec.Events
+	if len(storedEvents) == 0 {
+		return
+	}
+	loc.firstPosition = storedEvents[0].GlobalPosition
+	loc.lastPosition = storedEvents[len(storedEvents)-1].GlobalPosition
+	loc.occurredOn = storedEvents[len(storedEvents)-1].OccurredOn
+	aggregateID := storedEvents[0].AggregateID
+	db.index[aggregateID] = append(db.index[aggregateID], loc)
+	// events of one record are saved together, so they share metadata
+	key := causationKey{aggregateID: aggregateID, causationID: storedEvents[0].Metadata.CausationID}
+	db.causations[key] = append(db.causations[key], loc)
+	db.records = append(db.records, loc)
+	db.versions[aggregateID] = storedEvents[len(storedEvents)-1].StreamVersion
+	db.position = storedEvents[len(storedEvents)-1].GlobalPosition
+}
+
+// GetByID is get stored events by id from base stream version
+func (db *FileDB) GetByID(ctx context.Context, id string, base int64) ([]*StoredEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	results := make([]*StoredEvent, 0)
+	for _, loc := range db.index[id] {
+		rec, _, err := readRecord(db.segments[loc.segment], loc.offset)
+		if err != nil {
+			return nil, errors.Wrapf(err, "セグメント%dのオフセット%dからの読み込みに失敗しました", loc.segment, loc.offset)
+		}
+		for _, storedEvent := range rec.Events {
+			if storedEvent.StreamVersion >= base {
+				results = append(results, storedEvent)
+			}
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].StreamVersion < results[j].StreamVersion
+	})
+	return results, nil
+}
+
+// GetByCausationID is get stored events of aggregate with causation id in stream order (CausationDB interface)
+func (db *FileDB) GetByCausationID(ctx context.Context, aggregateID, causationID string) ([]*StoredEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	results := make([]*StoredEvent, 0)
+	for _, loc := range db.causations[causationKey{aggregateID: aggregateID, causationID: causationID}] {
+		rec, _, err := readRecord(db.segments[loc.segment], loc.offset)
+		if err != nil {
+			return nil, errors.Wrapf(err, "セグメント%dのオフセット%dからの読み込みに失敗しました", loc.segment, loc.offset)
+		}
+		results = append(results, rec.Events...)
+	}
+	return results, nil
+}
+
+// PruneCausations is forget causations of records occurred before (unix nano) (CausationPruner interface)
+//
+// Only the causation index is pruned, the records stay. It is rebuilt from segments on open, so prune again after it.
+func (db *FileDB) PruneCausations(ctx context.Context, before int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for key, locs := range db.causations {
+		if locs[len(locs)-1].occurredOn < before {
+			delete(db.causations, key)
+		}
+	}
+	return nil
+}
+
+// Append is append stored events and outbox entries when stream version matches expected version, and return new stream version
+func (db *FileDB) Append(ctx context.Context, aggregateID string, expectedVersion int64, storedEvents []*StoredEvent, outbox []*OutboxEntry) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	version := db.versions[aggregateID]
+	if err := checkExpectedVersion(aggregateID, expectedVersion, version); err != nil {
+		return version, err
+	}
+	if len(storedEvents) == 0 && len(outbox) == 0 {
+		return version, nil
+	}
+	position := db.position
+	for _, storedEvent := range storedEvents {
+		version++
+		position++
+		storedEvent.StreamVersion = version
+		storedEvent.GlobalPosition = position
+	}
+	if err := db.writeRecord(&fileRecord{Events: storedEvents, Outbox: outbox}); err != nil {
+		return db.versions[aggregateID], err
+	}
+	db.notifier.notify()
+	return version, nil
+}
+
+// writeRecord is write record to active segment and fsync, then index it
+func (db *FileDB) writeRecord(rec *fileRecord) error {
+	record, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	if db.activeSize > 0 && db.activeSize+int64(len(record)) > db.segmentSize {
+		if err := db.createSegment(db.active + 1); err != nil {
+			return err
+		}
+	}
+	f := db.segments[db.active]
+	if _, err := f.WriteAt(record, db.activeSize); err != nil {
+		f.Truncate(db.activeSize)
+		return errors.Wrap(err, "レコードの書き込みに失敗しました")
+	}
+	if err := f.Sync(); err != nil {
+		f.Truncate(db.activeSize)
+		return errors.Wrap(err, "レコードの同期に失敗しました")
+	}
+	db.indexRecord(fileRecordLocation{segment: db.active, offset: db.activeSize, size: int64(len(record))}, rec)
+	db.activeSize += int64(len(record))
+	return nil
+}
+
+// PendingOutbox is get not dispatched outbox entries in commit order (OutboxDB interface)
+func (db *FileDB) PendingOutbox(ctx context.Context, limit int64) ([]*OutboxEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	results := make([]*OutboxEntry, 0)
+	for _, entry := range db.outbox {
+		if int64(len(results)) >= limit {
+			break
+		}
+		results = append(results, entry.clone())
+	}
+	return results, nil
+}
+
+// MarkDispatched is mark outbox entry dispatched (OutboxDB interface)
+func (db *FileDB) MarkDispatched(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.writeRecord(&fileRecord{Dispatched: []string{id}})
+}
+
+// ReadAll is get stored events of all streams in commit order from global position
+func (db *FileDB) ReadAll(ctx context.Context, position, limit int64) ([]*StoredEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	results := make([]*StoredEvent, 0)
+	i := sort.Search(len(db.records), func(i int) bool {
+		return db.records[i].lastPosition >= position
+	})
+	for ; i < len(db.records) && int64(len(results)) < limit; i++ {
+		loc := db.records[i]
+		rec, _, err := readRecord(db.segments[loc.segment], loc.offset)
+		if err != nil {
+			return nil, errors.Wrapf(err, "セグメント%dのオフセット%dからの読み込みに失敗しました", loc.segment, loc.offset)
+		}
+		for _, storedEvent := range rec.Events {
+			if storedEvent.GlobalPosition >= position && int64(len(results)) < limit {
+				results = append(results, storedEvent)
+			}
+		}
+	}
+	return results, nil
+}
+
+// DeleteStream is physically delete stored events of aggregate by rewriting segments holding them
+//
+// Outbox entries committed with the events are kept, each affected segment is replaced atomically by rename.
+func (db *FileDB) DeleteStream(ctx context.Context, aggregateID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	segments := make(map[int]bool)
+	for _, loc := range db.index[aggregateID] {
+		segments[loc.segment] = true
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	ids := make([]int, 0, len(segments))
+	for id := range segments {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if err := db.rewriteSegment(id, aggregateID); err != nil {
+			return err
+		}
+	}
+	return db.reindex()
+}
+
+// rewriteSegment is rewrite segment without stored events of aggregate
+func (db *FileDB) rewriteSegment(id int, aggregateID string) error {
+	path := db.segmentPath(id)
+	tmp, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "セグメントの作成に失敗しました")
+	}
+	offset := int64(0)
+	written := int64(0)
+	for {
+		rec, size, err := readRecord(db.segments[id], offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tmp.Close()
+			return errors.Wrapf(err, "セグメント%dのオフセット%dからの読み込みに失敗しました", id, offset)
+		}
+		offset += size
+		if len(rec.Events) > 0 && rec.Events[0].AggregateID == aggregateID {
+			rec = &fileRecord{
+				Outbox:     rec.Outbox,
+				Dispatched: rec.Dispatched,
+				Position:   rec.Events[len(rec.Events)-1].GlobalPosition,
+			}
+		}
+		record, err := encodeRecord(rec)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := tmp.WriteAt(record, written); err != nil {
+			tmp.Close()
+			return errors.Wrap(err, "レコードの書き込みに失敗しました")
+		}
+		written += int64(len(record))
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "レコードの同期に失敗しました")
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "セグメントの置き換えに失敗しました")
+	}
+	if err := syncDir(db.dir); err != nil {
+		tmp.Close()
+		return err
+	}
+	db.segments[id].Close()
+	db.segments[id] = tmp
+	return nil
+}
+
+// reindex is rebuild index from open segments
+func (db *FileDB) reindex() error {
+	db.index = make(map[string][]fileRecordLocation)
+	db.causations = make(map[causationKey][]fileRecordLocation)
+	db.records = nil
+	db.versions = make(map[string]int64)
+	db.outbox = nil
+	ids := make([]int, 0, len(db.segments))
+	for id := range db.segments {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		size, err := db.scanSegment(id, db.segments[id])
+		if err != nil {
+			return errors.Wrapf(err, "セグメント%dが破損しています", id)
+		}
+		db.active = id
+		db.activeSize = size
+	}
+	return nil
+}
+
+// WaitCommit is channel closed on next commit
+func (db *FileDB) WaitCommit() <-chan struct{} {
+	return db.notifier.wait()
+}
+
+// Close is close segment files
+func (db *FileDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var result error
+	for id, f := range db.segments {
+		if err := f.Close(); err != nil && result == nil {
+			result = err
+		}
+		delete(db.segments, id)
+	}
+	return result
+}
+
+// createSegment is create new active segment
+func (db *FileDB) createSegment(id int) error {
+	f, err := os.OpenFile(db.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "セグメントの作成に失敗しました")
+	}
+	if err := syncDir(db.dir); err != nil {
+		f.Close()
+		return err
+	}
+	db.segments[id] = f
+	db.active = id
+	db.activeSize = 0
+	return nil
+}
+
+// segmentIDs is sorted segment ids in dir
+func (db *FileDB) segmentIDs() ([]int, error) {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "ディレクトリの読み込みに失敗しました")
+	}
+	ids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		var id int
+		if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), "%d", &id); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// segmentPath is path of segment file
+func (db *FileDB) segmentPath(id int) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, id, segmentSuffix))
+}
+
+// encodeRecord is encode file record
+func encodeRecord(rec *fileRecord) ([]byte, error) {
+	d, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, recordHeaderSize+len(d))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(d)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(d))
+	copy(record[recordHeaderSize:], d)
+	return record, nil
+}
+
+// readRecord is read record at offset, and return file record and record size
+//
+// io.EOF is returned only at the exact end of file, a partial record is io.ErrUnexpectedEOF.
+func readRecord(r io.ReaderAt, offset int64) (*fileRecord, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := r.ReadAt(header, offset)
+	if n == 0 && err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if n < recordHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordDataSize {
+		return nil, 0, errors.New("invalid record size")
+	}
+	d := make([]byte, size)
+	if n, _ := r.ReadAt(d, offset+recordHeaderSize); n < len(d) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(d) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errors.New("record checksum mismatch")
+	}
+	var rec fileRecord
+	if len(d) > 0 && d[0] == '[' {
+		// record written before outbox was stored with events
+		if err := json.Unmarshal(d, &rec.Events); err != nil {
+			return nil, 0, err
+		}
+	} else if err := json.Unmarshal(d, &rec); err != nil {
+		return nil, 0, err
+	}
+	return &rec, int64(recordHeaderSize + len(d)), nil
+}
+
+// syncDir is fsync directory to persist file creation
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "ディレクトリのオープンに失敗しました")
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "ディレクトリの同期に失敗しました")
+	}
+	return nil
+}
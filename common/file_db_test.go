@@ -0,0 +1,211 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func newTestStoredEvents(aggregateID string, n int) []*StoredEvent {
+	storedEvents := make([]*StoredEvent, 0, n)
+	for i := 0; i < n; i++ {
+		storedEvents = append(storedEvents, &StoredEvent{
+			EventID:     fmt.Sprintf("%s-%d", aggregateID, i),
+			AggregateID: aggregateID,
+			EventType:   "TestEvent",
+			ContentType: ContentTypeJSON,
+			Data:        []byte(`{"Value":"test"}`),
+		})
+	}
+	return storedEvents
+}
+
+func openTestFileDB(t *testing.T, dir string, segmentSize int64) *FileDB {
+	t.Helper()
+	db, err := NewFileDB(dir, segmentSize, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestFileDBTruncatesTornWrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db := openTestFileDB(t, dir, 0)
+	if _, err := db.Append(ctx, "a", ExpectedVersionNoStream, newTestStoredEvents("a", 2), nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	path := filepath.Join(dir, fmt.Sprintf("%s%020d%s", segmentPrefix, 1, segmentSuffix))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := encodeRecord(&fileRecord{Events: newTestStoredEvents("b", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(record[:len(record)/2]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db = openTestFileDB(t, dir, 0)
+	defer db.Close()
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != info.Size() {
+		t.Fatalf("segment size is %d, want %d", after.Size(), info.Size())
+	}
+	storedEvents, err := db.GetByID(ctx, "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storedEvents) != 2 {
+		t.Fatalf("got %d events, want 2", len(storedEvents))
+	}
+	if storedEvents, _ := db.GetByID(ctx, "b", 0); len(storedEvents) != 0 {
+		t.Fatalf("torn record is visible: %v", storedEvents)
+	}
+	version, err := db.Append(ctx, "b", ExpectedVersionNoStream, newTestStoredEvents("b", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatalf("version is %d, want 1", version)
+	}
+}
+
+func TestFileDBRotatesSegments(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db := openTestFileDB(t, dir, 512)
+	for i := 0; i < 10; i++ {
+		if _, err := db.Append(ctx, fmt.Sprintf("agg-%d", i), ExpectedVersionNoStream, newTestStoredEvents(fmt.Sprintf("agg-%d", i), 2), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	ids, err := (&FileDB{dir: dir}).segmentIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) < 2 {
+		t.Fatalf("got %d segments, want rotation", len(ids))
+	}
+
+	db = openTestFileDB(t, dir, 512)
+	defer db.Close()
+
+	storedEvents, err := db.ReadAll(ctx, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storedEvents) != 20 {
+		t.Fatalf("got %d events, want 20", len(storedEvents))
+	}
+	for i, storedEvent := range storedEvents {
+		if storedEvent.GlobalPosition != int64(i+1) {
+			t.Fatalf("event %d has position %d", i, storedEvent.GlobalPosition)
+		}
+	}
+	version, err := db.Append(ctx, "agg-9", 2, newTestStoredEvents("agg-9-next", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 {
+		t.Fatalf("version is %d, want 3", version)
+	}
+}
+
+func TestFileDBKeepsPositionsAfterDeleteStream(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db := openTestFileDB(t, dir, 0)
+	if _, err := db.Append(ctx, "a", ExpectedVersionNoStream, newTestStoredEvents("a", 1), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Append(ctx, "b", ExpectedVersionNoStream, newTestStoredEvents("b", 2), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteStream(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if storedEvents, _ := db.GetByID(ctx, "b", 0); len(storedEvents) != 0 {
+		t.Fatalf("deleted events are visible: %v", storedEvents)
+	}
+	db.Close()
+
+	db = openTestFileDB(t, dir, 0)
+	defer db.Close()
+
+	storedEvents, err := db.ReadAll(ctx, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storedEvents) != 1 || storedEvents[0].AggregateID != "a" {
+		t.Fatalf("got %v, want only a", storedEvents)
+	}
+	appended := newTestStoredEvents("c", 1)
+	if _, err := db.Append(ctx, "c", ExpectedVersionNoStream, appended, nil); err != nil {
+		t.Fatal(err)
+	}
+	if appended[0].GlobalPosition != 4 {
+		t.Fatalf("position is %d, want 4 (positions of deleted events are not reused)", appended[0].GlobalPosition)
+	}
+	if _, err := db.Append(ctx, "b", ExpectedVersionNoStream, newTestStoredEvents("b", 1), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileDBPrunesCausations(t *testing.T) {
+	ctx := context.Background()
+	db := openTestFileDB(t, t.TempDir(), 0)
+	defer db.Close()
+
+	for i, occurredOn := range []int64{100, 200} {
+		storedEvents := newTestStoredEvents(fmt.Sprintf("a-%d", i), 1)
+		storedEvents[0].AggregateID = "a"
+		storedEvents[0].OccurredOn = occurredOn
+		storedEvents[0].Metadata.CausationID = fmt.Sprintf("c%d", i)
+		if _, err := db.Append(ctx, "a", int64(i), storedEvents, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PruneCausations(ctx, 150); err != nil {
+		t.Fatal(err)
+	}
+	for causationID, want := range map[string]int{"c0": 0, "c1": 1} {
+		storedEvents, err := db.GetByCausationID(ctx, "a", causationID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(storedEvents) != want {
+			t.Fatalf("got %d events caused by %s, want %d", len(storedEvents), causationID, want)
+		}
+	}
+	storedEvents, err := db.GetByID(ctx, "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storedEvents) != 2 {
+		t.Fatalf("got %d events, want 2", len(storedEvents))
+	}
+}
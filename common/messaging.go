@@ -2,7 +2,6 @@ package common
 
 import (
 	"context"
-	"encoding/json"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
@@ -11,8 +10,9 @@ import (
 
 // InMemoryMessage is in memory message model
 type InMemoryMessage struct {
-	Header string
-	Data   []byte
+	Header      string
+	ContentType string
+	Data        []byte
 }
 
 // MessageContext is message interface
@@ -31,36 +31,57 @@ func NewMessageID() (string, error) {
 	return id.String(), nil
 }
 
+// EncodedMessageContext is message already serialized, published as is
+type EncodedMessageContext interface {
+	Encoded() (contentType string, data []byte)
+}
+
 // MessagingProducerContext is messaging producer interface
 type MessagingProducerContext interface {
-	Publish(m MessageContext) error
+	Publish(ctx context.Context, m MessageContext) error
 }
 
 // FakeMessagingProducer is fake messaging producer
 type FakeMessagingProducer struct {
-	channel chan<- *InMemoryMessage
-	logger  *zap.SugaredLogger
+	channel    chan<- *InMemoryMessage
+	serializer Serializer
+	logger     *zap.SugaredLogger
 }
 
 // NewFakeMessagingProducer is new fake messaging producer
 func NewFakeMessagingProducer(ch chan<- *InMemoryMessage, logger *zap.SugaredLogger) *FakeMessagingProducer {
 	return &FakeMessagingProducer{
-		channel: ch,
-		logger:  logger,
+		channel:    ch,
+		serializer: JSONSerializer{},
+		logger:     logger,
 	}
 }
 
+// SetSerializer is set serializer of published messages (JSON by default)
+func (p *FakeMessagingProducer) SetSerializer(s Serializer) {
+	p.serializer = s
+}
+
 // Publish is publish message
-func (p *FakeMessagingProducer) Publish(m MessageContext) error {
-	d, err := json.Marshal(m)
-	if err != nil {
-		return err
-	}
+func (p *FakeMessagingProducer) Publish(ctx context.Context, m MessageContext) error {
 	msg := &InMemoryMessage{
 		Header: m.GetMessageType(),
-		Data:   d,
 	}
-	p.channel <- msg
+	if em, ok := m.(EncodedMessageContext); ok {
+		msg.ContentType, msg.Data = em.Encoded()
+	} else {
+		d, err := p.serializer.Marshal(m)
+		if err != nil {
+			return err
+		}
+		msg.ContentType = p.serializer.ContentType()
+		msg.Data = d
+	}
+	select {
+	case p.channel <- msg:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	p.logger.Infow("publish message", "message", msg)
 	return nil
 }
@@ -91,7 +112,11 @@ func (c *FakeMessagingConsumer) Consume(ctx context.Context, msg chan<- *InMemor
 		case <-ctx.Done():
 			return ctx.Err()
 		case m := <-c.channel:
-			msg <- m
+			select {
+			case msg <- m:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 			c.logger.Infow("consume message", "message", m)
 		}
 	}
@@ -0,0 +1,585 @@
+package common
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// MsgpackSerializer is MessagePack serializer, compact and readable from other languages
+//
+// Structs are maps keyed by field name (or the name of `msgpack:"name"` tag, "-" skips the field),
+// so fields can be added and removed as with JSON. Extension types are not supported.
+type MsgpackSerializer struct{}
+
+// ContentType is content type (Serializer interface)
+func (MsgpackSerializer) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+// Marshal is marshal (Serializer interface)
+func (MsgpackSerializer) Marshal(v interface{}) ([]byte, error) {
+	return appendMsgpack(nil, reflect.ValueOf(v))
+}
+
+// Unmarshal is unmarshal (Serializer interface)
+func (MsgpackSerializer) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("msgpack: unmarshal target must be a non-nil pointer")
+	}
+	d := &msgpackDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errors.Errorf("msgpack: %d trailing bytes", len(d.data)-d.pos)
+	}
+	return nil
+}
+
+// msgpackField is struct field encoded as map entry
+type msgpackField struct {
+	name  string
+	index int
+}
+
+// msgpackFields is fields of struct type in declaration order
+func msgpackFields(t reflect.Type) []msgpackField {
+	fields := make([]msgpackField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("msgpack"); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields = append(fields, msgpackField{name: name, index: i})
+	}
+	return fields
+}
+
+// appendMsgpack is append encoded value to b
+func appendMsgpack(b []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(b, 0xc0), nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		return appendMsgpack(b, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendMsgpackInt(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendMsgpackUint(b, v.Uint()), nil
+	case reflect.Float32:
+		return appendUint32(append(b, 0xca), math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return appendUint64(append(b, 0xcb), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return appendMsgpackString(b, v.String()), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendMsgpackBytes(b, v.Bytes()), nil
+		}
+		return appendMsgpackArray(b, v)
+	case reflect.Array:
+		return appendMsgpackArray(b, v)
+	case reflect.Map:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		return appendMsgpackMap(b, v)
+	case reflect.Struct:
+		fields := msgpackFields(v.Type())
+		b = appendMsgpackHeader(b, len(fields), 0x80, 0xde, 0xdf)
+		for _, f := range fields {
+			b = appendMsgpackString(b, f.name)
+			var err error
+			if b, err = appendMsgpack(b, v.Field(f.index)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, errors.Errorf("msgpack: unsupported type %s", v.Type())
+}
+
+// appendMsgpackInt is append int in the smallest format
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return appendMsgpackUint(b, uint64(i))
+	case i >= -32:
+		return append(b, byte(i))
+	case i >= math.MinInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return appendUint16(append(b, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return appendUint32(append(b, 0xd2), uint32(i))
+	}
+	return appendUint64(append(b, 0xd3), uint64(i))
+}
+
+// appendMsgpackUint is append uint in the smallest format
+func appendMsgpackUint(b []byte, u uint64) []byte {
+	switch {
+	case u <= 0x7f:
+		return append(b, byte(u))
+	case u <= math.MaxUint8:
+		return append(b, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return appendUint16(append(b, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		return appendUint32(append(b, 0xce), uint32(u))
+	}
+	return appendUint64(append(b, 0xcf), u)
+}
+
+// appendUint16 is append big endian uint16 (binary.BigEndian.AppendUint16 needs go 1.19)
+func appendUint16(b []byte, u uint16) []byte {
+	return append(b, byte(u>>8), byte(u))
+}
+
+// appendUint32 is append big endian uint32
+func appendUint32(b []byte, u uint32) []byte {
+	return append(b, byte(u>>24), byte(u>>16), byte(u>>8), byte(u))
+}
+
+// appendUint64 is append big endian uint64
+func appendUint64(b []byte, u uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(u>>32)), uint32(u))
+}
+
+// appendMsgpackString is append str
+func appendMsgpackString(b []byte, s string) []byte {
+	if len(s) <= 31 {
+		b = append(b, 0xa0|byte(len(s)))
+	} else if len(s) <= math.MaxUint8 {
+		b = append(b, 0xd9, byte(len(s)))
+	} else {
+		b = appendMsgpackHeader(b, len(s), 0, 0xda, 0xdb)
+	}
+	return append(b, s...)
+}
+
+// appendMsgpackBytes is append bin
+func appendMsgpackBytes(b []byte, p []byte) []byte {
+	if len(p) <= math.MaxUint8 {
+		b = append(b, 0xc4, byte(len(p)))
+	} else {
+		b = appendMsgpackHeader(b, len(p), 0, 0xc5, 0xc6)
+	}
+	return append(b, p...)
+}
+
+// appendMsgpackHeader is append length of array, map or str/bin (fix 0 has no fixed format) in the smallest format
+func appendMsgpackHeader(b []byte, n int, fix, code16, code32 byte) []byte {
+	switch {
+	case fix != 0 && n <= 15:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(b, code16), uint16(n))
+	}
+	return appendUint32(append(b, code32), uint32(n))
+}
+
+// appendMsgpackArray is append array of slice or array
+func appendMsgpackArray(b []byte, v reflect.Value) ([]byte, error) {
+	b = appendMsgpackHeader(b, v.Len(), 0x90, 0xdc, 0xdd)
+	for i := 0; i < v.Len(); i++ {
+		var err error
+		if b, err = appendMsgpack(b, v.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// appendMsgpackMap is append map, entries are sorted by encoded key so equal maps encode equally
+func appendMsgpackMap(b []byte, v reflect.Value) ([]byte, error) {
+	type entry struct{ key, value []byte }
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := appendMsgpack(nil, iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		value, err := appendMsgpack(nil, iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{key: key, value: value})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	b = appendMsgpackHeader(b, len(entries), 0x80, 0xde, 0xdf)
+	for _, e := range entries {
+		b = append(append(b, e.key...), e.value...)
+	}
+	return b, nil
+}
+
+// msgpackDecoder is decoder of one MessagePack value
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+// msgpack value families, decoded by the code of the value
+const (
+	msgpackNil = iota
+	msgpackBool
+	msgpackInt
+	msgpackUint
+	msgpackFloat
+	msgpackString
+	msgpackBytes
+	msgpackArray
+	msgpackMap
+)
+
+// msgpackFamilies is names of value families for errors
+var msgpackFamilies = []string{"nil", "bool", "int", "uint", "float", "str", "bin", "array", "map"}
+
+// msgpackSized is codes followed by length of size bytes
+var msgpackSized = map[byte]struct {
+	family int
+	size   int
+}{
+	0xc4: {msgpackBytes, 1}, 0xc5: {msgpackBytes, 2}, 0xc6: {msgpackBytes, 4},
+	0xd9: {msgpackString, 1}, 0xda: {msgpackString, 2}, 0xdb: {msgpackString, 4},
+	0xdc: {msgpackArray, 2}, 0xdd: {msgpackArray, 4},
+	0xde: {msgpackMap, 2}, 0xdf: {msgpackMap, 4},
+}
+
+// msgpackHead is head of value, n is length of string, bytes, array and map
+type msgpackHead struct {
+	family int
+	b      bool
+	i      int64
+	u      uint64
+	f      float64
+	n      int
+}
+
+// next is read n bytes
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errors.New("msgpack: unexpected end of data")
+	}
+	p := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return p, nil
+}
+
+// uint is read big endian unsigned integer of n bytes
+func (d *msgpackDecoder) readUint(n int) (uint64, error) {
+	p, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	u := uint64(0)
+	for _, c := range p {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// head is read head of next value, the payload of string and bytes follows it
+func (d *msgpackDecoder) head() (msgpackHead, error) {
+	p, err := d.next(1)
+	if err != nil {
+		return msgpackHead{}, err
+	}
+	code := p[0]
+	switch {
+	case code <= 0x7f:
+		return msgpackHead{family: msgpackUint, u: uint64(code)}, nil
+	case code >= 0xe0:
+		return msgpackHead{family: msgpackInt, i: int64(int8(code))}, nil
+	case code&0xf0 == 0x80:
+		return msgpackHead{family: msgpackMap, n: int(code & 0x0f)}, nil
+	case code&0xf0 == 0x90:
+		return msgpackHead{family: msgpackArray, n: int(code & 0x0f)}, nil
+	case code&0xe0 == 0xa0:
+		return msgpackHead{family: msgpackString, n: int(code & 0x1f)}, nil
+	}
+	if s, ok := msgpackSized[code]; ok {
+		n, err := d.readUint(s.size)
+		if err != nil {
+			return msgpackHead{}, err
+		}
+		if n > uint64(len(d.data)) {
+			return msgpackHead{}, errors.New("msgpack: length exceeds data")
+		}
+		return msgpackHead{family: s.family, n: int(n)}, nil
+	}
+	switch code {
+	case 0xc0:
+		return msgpackHead{family: msgpackNil}, nil
+	case 0xc2, 0xc3:
+		return msgpackHead{family: msgpackBool, b: code == 0xc3}, nil
+	case 0xca:
+		u, err := d.readUint(4)
+		return msgpackHead{family: msgpackFloat, f: float64(math.Float32frombits(uint32(u)))}, err
+	case 0xcb:
+		u, err := d.readUint(8)
+		return msgpackHead{family: msgpackFloat, f: math.Float64frombits(u)}, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.readUint(1 << (code - 0xcc))
+		return msgpackHead{family: msgpackUint, u: u}, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		u, err := d.readUint(size)
+		// sign extend from size bytes
+		shift := uint(64 - 8*size)
+		return msgpackHead{family: msgpackInt, i: int64(u<<shift) >> shift}, err
+	}
+	return msgpackHead{}, errors.Errorf("msgpack: unsupported code 0x%x", code)
+}
+
+// decode is decode next value into v
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	h, err := d.head()
+	if err != nil {
+		return err
+	}
+	return d.decodeHead(h, v)
+}
+
+// decodeHead is decode value of head h into v
+func (d *msgpackDecoder) decodeHead(h msgpackHead, v reflect.Value) error {
+	if h.family == msgpackNil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeHead(h, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return errors.Errorf("msgpack: cannot decode into %s", v.Type())
+		}
+		value, err := d.generic(h)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(value))
+		}
+		return nil
+	case reflect.Bool:
+		if h.family != msgpackBool {
+			return d.mismatch(h, v)
+		}
+		v.SetBool(h.b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := h.i
+		switch {
+		case h.family == msgpackUint && h.u <= math.MaxInt64:
+			i = int64(h.u)
+		case h.family != msgpackInt:
+			return d.mismatch(h, v)
+		}
+		if v.OverflowInt(i) {
+			return errors.Errorf("msgpack: %d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if h.family != msgpackUint {
+			return d.mismatch(h, v)
+		}
+		if v.OverflowUint(h.u) {
+			return errors.Errorf("msgpack: %d overflows %s", h.u, v.Type())
+		}
+		v.SetUint(h.u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		switch h.family {
+		case msgpackFloat:
+			v.SetFloat(h.f)
+		case msgpackInt:
+			v.SetFloat(float64(h.i))
+		case msgpackUint:
+			v.SetFloat(float64(h.u))
+		default:
+			return d.mismatch(h, v)
+		}
+		return nil
+	case reflect.String:
+		if h.family != msgpackString && h.family != msgpackBytes {
+			return d.mismatch(h, v)
+		}
+		p, err := d.next(h.n)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(p))
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && (h.family == msgpackBytes || h.family == msgpackString) {
+			p, err := d.next(h.n)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte{}, p...))
+			return nil
+		}
+		if h.family != msgpackArray {
+			return d.mismatch(h, v)
+		}
+		s := reflect.MakeSlice(v.Type(), h.n, h.n)
+		for i := 0; i < h.n; i++ {
+			if err := d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	case reflect.Array:
+		if h.family != msgpackArray || h.n != v.Len() {
+			return d.mismatch(h, v)
+		}
+		for i := 0; i < h.n; i++ {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if h.family != msgpackMap {
+			return d.mismatch(h, v)
+		}
+		m := reflect.MakeMapWithSize(v.Type(), h.n)
+		for i := 0; i < h.n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+		return nil
+	case reflect.Struct:
+		if h.family != msgpackMap {
+			return d.mismatch(h, v)
+		}
+		fields := make(map[string]int)
+		for _, f := range msgpackFields(v.Type()) {
+			fields[f.name] = f.index
+		}
+		for i := 0; i < h.n; i++ {
+			var name string
+			if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+				return err
+			}
+			index, ok := fields[name]
+			if !ok {
+				// unknown fields (removed from the struct) are skipped
+				var skip interface{}
+				if err := d.decode(reflect.ValueOf(&skip).Elem()); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Field(index)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.Errorf("msgpack: cannot decode into %s", v.Type())
+}
+
+// generic is value of head h as interface{}, maps with string keys are map[string]interface{}
+func (d *msgpackDecoder) generic(h msgpackHead) (interface{}, error) {
+	switch h.family {
+	case msgpackNil:
+		return nil, nil
+	case msgpackBool:
+		return h.b, nil
+	case msgpackInt:
+		return h.i, nil
+	case msgpackUint:
+		return h.u, nil
+	case msgpackFloat:
+		return h.f, nil
+	case msgpackString:
+		p, err := d.next(h.n)
+		return string(p), err
+	case msgpackBytes:
+		p, err := d.next(h.n)
+		return append([]byte{}, p...), err
+	case msgpackArray:
+		s := make([]interface{}, h.n)
+		for i := range s {
+			if err := d.decode(reflect.ValueOf(&s[i]).Elem()); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+	m := make(map[interface{}]interface{}, h.n)
+	stringKeys := true
+	for i := 0; i < h.n; i++ {
+		var key, value interface{}
+		if err := d.decode(reflect.ValueOf(&key).Elem()); err != nil {
+			return nil, err
+		}
+		if err := d.decode(reflect.ValueOf(&value).Elem()); err != nil {
+			return nil, err
+		}
+		if _, ok := key.(string); !ok {
+			stringKeys = false
+		}
+		if key != nil && !reflect.TypeOf(key).Comparable() {
+			return nil, errors.New("msgpack: map key is not comparable")
+		}
+		m[key] = value
+	}
+	if !stringKeys {
+		return m, nil
+	}
+	sm := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		sm[k.(string)] = v
+	}
+	return sm, nil
+}
+
+// mismatch is error of value of head h not decodable into v
+func (d *msgpackDecoder) mismatch(h msgpackHead, v reflect.Value) error {
+	return errors.Errorf("msgpack: cannot decode %s into %s", msgpackFamilies[h.family], v.Type())
+}
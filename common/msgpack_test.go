@@ -0,0 +1,111 @@
+package common
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type msgpackTestValue struct {
+	String  string
+	Long    string
+	Int     int64
+	Neg     int
+	Uint    uint16
+	Float   float64
+	Bool    bool
+	Bytes   []byte
+	Strings []string
+	Headers map[string]string
+	Nested  *msgpackTestValue
+	Renamed string `msgpack:"renamed"`
+	Skipped string `msgpack:"-"`
+	private string
+}
+
+func TestMsgpackSerializerRoundTrip(t *testing.T) {
+	s := MsgpackSerializer{}
+	in := &msgpackTestValue{
+		String:  "todo",
+		Long:    strings.Repeat("x", 70000),
+		Int:     math.MaxInt64,
+		Neg:     -40000,
+		Uint:    300,
+		Float:   1.5,
+		Bool:    true,
+		Bytes:   []byte{0, 1, 2},
+		Strings: []string{"a", "b"},
+		Headers: map[string]string{"k": "v"},
+		Nested:  &msgpackTestValue{String: "nested", Neg: -1},
+		Renamed: "renamed",
+		Skipped: "skipped",
+		private: "private",
+	}
+	data, err := s.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out msgpackTestValue
+	if err := s.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Skipped, in.private = "", ""
+	if !reflect.DeepEqual(in, &out) {
+		t.Fatalf("got %+v, want %+v", out, in)
+	}
+}
+
+func TestMsgpackSerializerWireFormat(t *testing.T) {
+	s := MsgpackSerializer{}
+	for _, c := range []struct {
+		value interface{}
+		want  []byte
+	}{
+		{map[string]int{"b": 2, "a": 1}, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02}},
+		{struct{ A int8 }{-33}, []byte{0x81, 0xa1, 'A', 0xd0, 0xdf}},
+		{[]interface{}{nil, false, uint64(256), "x"}, []byte{0x94, 0xc0, 0xc2, 0xcd, 0x01, 0x00, 0xa1, 'x'}},
+	} {
+		got, err := s.Marshal(c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Fatalf("%#v encoded to % x, want % x", c.value, got, c.want)
+		}
+	}
+}
+
+func TestMsgpackSerializerDecodesUnknownAndGeneric(t *testing.T) {
+	s := MsgpackSerializer{}
+	data, err := s.Marshal(map[string]interface{}{
+		"String":  "kept",
+		"Removed": []interface{}{map[string]interface{}{"x": 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var typed msgpackTestValue
+	if err := s.Unmarshal(data, &typed); err != nil {
+		t.Fatal(err)
+	}
+	if typed.String != "kept" {
+		t.Fatalf("got %q, want kept", typed.String)
+	}
+	var generic interface{}
+	if err := s.Unmarshal(data, &generic); err != nil {
+		t.Fatal(err)
+	}
+	removed := generic.(map[string]interface{})["Removed"].([]interface{})
+	if removed[0].(map[string]interface{})["x"] != uint64(1) {
+		t.Fatalf("got %#v", generic)
+	}
+	if err := s.Unmarshal(data[:len(data)-1], &generic); err == nil {
+		t.Fatal("truncated data decoded")
+	}
+	var n int8
+	if err := s.Unmarshal([]byte{0xcd, 0x01, 0x00}, &n); err == nil {
+		t.Fatal("overflow decoded")
+	}
+}
@@ -0,0 +1,167 @@
+package common
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// relay settings
+const (
+	outboxBatchSize         int64 = 100
+	outboxPollInterval            = time.Second
+	outboxMaxAttempts             = 5
+	outboxInitialRetryDelay       = 100 * time.Millisecond
+)
+
+// OutboxEntry is message stored atomically with events, waiting to be published
+type OutboxEntry struct {
+	ID          string
+	MessageType string
+	ContentType string
+	Data        []byte
+	CreatedAt   int64
+	Dispatched  bool
+}
+
+// newOutboxEntries is outbox entries of messages serialized by s
+func newOutboxEntries(s Serializer, messages []MessageContext) ([]*OutboxEntry, error) {
+	entries := make([]*OutboxEntry, 0, len(messages))
+	for _, m := range messages {
+		d, err := s.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &OutboxEntry{
+			ID:          m.GetMessageID(),
+			MessageType: m.GetMessageType(),
+			ContentType: s.ContentType(),
+			Data:        d,
+			CreatedAt:   time.Now().UnixNano(),
+		})
+	}
+	return entries, nil
+}
+
+// clone is deep copy of outbox entry
+func (e *OutboxEntry) clone() *OutboxEntry {
+	c := *e
+	if e.Data != nil {
+		c.Data = append([]byte(nil), e.Data...)
+	}
+	return &c
+}
+
+// OutboxDB is outbox database interface
+type OutboxDB interface {
+	// PendingOutbox is get not dispatched entries in commit order
+	PendingOutbox(ctx context.Context, limit int64) ([]*OutboxEntry, error)
+	MarkDispatched(ctx context.Context, id string) error
+	WaitCommit() <-chan struct{}
+}
+
+// outboxMessage is outbox entry as message, published with stored data as is
+type outboxMessage struct {
+	entry *OutboxEntry
+}
+
+// GetMessageID is get message id (MessageContext interface)
+func (m *outboxMessage) GetMessageID() string {
+	return m.entry.ID
+}
+
+// GetMessageType is get message type (MessageContext interface)
+func (m *outboxMessage) GetMessageType() string {
+	return m.entry.MessageType
+}
+
+// Encoded is stored content type and data (EncodedMessageContext interface)
+func (m *outboxMessage) Encoded() (string, []byte) {
+	contentType := m.entry.ContentType
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+	return contentType, m.entry.Data
+}
+
+// OutboxRelay is relay of outbox entries to messaging producer
+//
+// Entries are published in commit order and marked dispatched only after publish succeeded,
+// so a message may be published more than once (at-least-once) but is never lost.
+type OutboxRelay struct {
+	db       OutboxDB
+	producer MessagingProducerContext
+	logger   *zap.SugaredLogger
+}
+
+// NewOutboxRelay is new outbox relay
+func NewOutboxRelay(db OutboxDB, producer MessagingProducerContext, logger *zap.SugaredLogger) *OutboxRelay {
+	return &OutboxRelay{
+		db:       db,
+		producer: producer,
+		logger:   logger,
+	}
+}
+
+// Run is relay pending entries until ctx is done
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		committed := r.db.WaitCommit()
+		if err := r.RelayPending(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Warnw("failed to relay outbox", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-committed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// RelayPending is publish pending entries once, stop at first entry failed after retries to keep order
+func (r *OutboxRelay) RelayPending(ctx context.Context) error {
+	for {
+		entries, err := r.db.PendingOutbox(ctx, outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := r.publish(ctx, entry); err != nil {
+				return err
+			}
+			if err := r.db.MarkDispatched(ctx, entry.ID); err != nil {
+				return err
+			}
+		}
+		if int64(len(entries)) < outboxBatchSize {
+			return nil
+		}
+	}
+}
+
+// publish is publish entry with exponential backoff retries
+func (r *OutboxRelay) publish(ctx context.Context, entry *OutboxEntry) error {
+	delay := outboxInitialRetryDelay
+	var err error
+	for attempt := 1; attempt <= outboxMaxAttempts; attempt++ {
+		if err = r.producer.Publish(ctx, &outboxMessage{entry: entry}); err == nil {
+			return nil
+		}
+		r.logger.Warnw("failed to publish outbox entry", "id", entry.ID, "attempt", attempt, "error", err)
+		if attempt == outboxMaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	return err
+}
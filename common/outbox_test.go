@@ -0,0 +1,109 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var errTestPublish = errors.New("publish failed")
+
+// failingProducer is producer failing the given number of times per message id, forever when negative
+type failingProducer struct {
+	mu        sync.Mutex
+	failures  map[string]int
+	onFailure func()
+	published []string
+}
+
+func (p *failingProducer) Publish(ctx context.Context, m MessageContext) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n := p.failures[m.GetMessageID()]; n != 0 {
+		p.failures[m.GetMessageID()] = n - 1
+		if p.onFailure != nil {
+			p.onFailure()
+		}
+		return errTestPublish
+	}
+	p.published = append(p.published, m.GetMessageID())
+	return nil
+}
+
+func newTestOutboxDB(t *testing.T, n int) *InMemoryDB {
+	t.Helper()
+	db := NewInMemoryDB(zap.NewNop().Sugar())
+	for i := 1; i <= n; i++ {
+		aggregateID := fmt.Sprintf("a%d", i)
+		outbox := []*OutboxEntry{{ID: fmt.Sprintf("m%d", i), MessageType: "TestMessage", Data: []byte(`{}`)}}
+		if _, err := db.Append(context.Background(), aggregateID, ExpectedVersionNoStream, newTestStoredEvents(aggregateID, 1), outbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func pendingOutboxIDs(t *testing.T, db OutboxDB) []string {
+	t.Helper()
+	entries, err := db.PendingOutbox(context.Background(), outboxBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func TestOutboxRelayStopsAtFailedEntry(t *testing.T) {
+	db := newTestOutboxDB(t, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// cancel during backoff, so the relay gives up on m2 without waiting for all attempts
+	producer := &failingProducer{failures: map[string]int{"m2": -1}, onFailure: cancel}
+	relay := NewOutboxRelay(db, producer, zap.NewNop().Sugar())
+
+	if err := relay.RelayPending(ctx); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if want := []string{"m1"}; !reflect.DeepEqual(producer.published, want) {
+		t.Fatalf("got published %v, want %v", producer.published, want)
+	}
+	if got, want := pendingOutboxIDs(t, db), []string{"m2", "m3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got pending %v, want %v", got, want)
+	}
+
+	producer.failures["m2"] = 0
+	if err := relay.RelayPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"m1", "m2", "m3"}; !reflect.DeepEqual(producer.published, want) {
+		t.Fatalf("got published %v, want %v", producer.published, want)
+	}
+	if got := pendingOutboxIDs(t, db); len(got) != 0 {
+		t.Fatalf("got pending %v, want none", got)
+	}
+}
+
+func TestOutboxRelayRetriesInOrder(t *testing.T) {
+	db := newTestOutboxDB(t, 3)
+	producer := &failingProducer{failures: map[string]int{"m2": 1}}
+	relay := NewOutboxRelay(db, producer, zap.NewNop().Sugar())
+
+	if err := relay.RelayPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"m1", "m2", "m3"}; !reflect.DeepEqual(producer.published, want) {
+		t.Fatalf("got published %v, want %v", producer.published, want)
+	}
+	if got := pendingOutboxIDs(t, db); len(got) != 0 {
+		t.Fatalf("got pending %v, want none", got)
+	}
+}
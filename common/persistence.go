@@ -1,16 +1,79 @@
 package common
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"sort"
+	"sync"
 
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// expected versions
+const (
+	// ExpectedVersionAny is skip stream version check
+	ExpectedVersionAny int64 = -2
+	// ExpectedVersionNoStream is stream must not exist
+	ExpectedVersionNoStream int64 = -1
+)
+
+// ErrConcurrencyConflict is stream version mismatch error
+type ErrConcurrencyConflict struct {
+	AggregateID     string
+	ExpectedVersion int64
+	ActualVersion   int64
+}
+
+// Error is error message (error interface)
+func (e *ErrConcurrencyConflict) Error() string {
+	return fmt.Sprintf("concurrency conflict: aggregate %s expected version %d but actual version %d", e.AggregateID, e.ExpectedVersion, e.ActualVersion)
+}
+
+// checkExpectedVersion is check expected version against actual version
+func checkExpectedVersion(aggregateID string, expectedVersion, actualVersion int64) error {
+	switch expectedVersion {
+	case ExpectedVersionAny:
+		return nil
+	case ExpectedVersionNoStream:
+		if actualVersion == 0 {
+			return nil
+		}
+	default:
+		if actualVersion == expectedVersion {
+			return nil
+		}
+	}
+	return &ErrConcurrencyConflict{
+		AggregateID:     aggregateID,
+		ExpectedVersion: expectedVersion,
+		ActualVersion:   actualVersion,
+	}
+}
+
+// EventDB is event database interface
+//
+// Append stores outbox entries in the same commit as stored events.
+type EventDB interface {
+	GetByID(ctx context.Context, id string, base int64) ([]*StoredEvent, error)
+	Append(ctx context.Context, aggregateID string, expectedVersion int64, storedEvents []*StoredEvent, outbox []*OutboxEntry) (int64, error)
+	ReadAll(ctx context.Context, position, limit int64) ([]*StoredEvent, error)
+	WaitCommit() <-chan struct{}
+	DeleteStream(ctx context.Context, aggregateID string) error
+}
+
 // InMemoryDB is database
+//
+// InMemoryDB is safe for concurrent use. Stored events are copied on write and read,
+// so callers never share state with the database.
 type InMemoryDB struct {
-	data   map[string][]*StoredEvent
-	logger *zap.SugaredLogger
+	mu       sync.RWMutex
+	data     map[string][]*StoredEvent
+	all      []*StoredEvent
+	position int64
+	outbox   []*OutboxEntry
+	notifier commitNotifier
+	logger   *zap.SugaredLogger
 }
 
 // NewInMemoryDB is new in memory db
@@ -21,114 +84,543 @@ func NewInMemoryDB(logger *zap.SugaredLogger) *InMemoryDB {
 	}
 }
 
-// GetByID is get stored events by id
-func (db *InMemoryDB) GetByID(id string) []*StoredEvent {
+// GetByID is get stored events by id from base stream version
+func (db *InMemoryDB) GetByID(ctx context.Context, id string, base int64) ([]*StoredEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
 	results := make([]*StoredEvent, 0)
-	results = append(results, db.data[id]...)
+	for _, storedEvent := range db.data[id] {
+		if storedEvent.StreamVersion >= base {
+			results = append(results, storedEvent.clone())
+		}
+	}
 	sort.SliceStable(results, func(i, j int) bool {
-		switch {
-		case results[i].StreamVersion < results[j].StreamVersion:
-			return true
-		case results[i].StreamVersion > results[j].StreamVersion:
-			return false
-		default:
-			return results[i].OccurredOn < results[j].OccurredOn
+		return results[i].StreamVersion < results[j].StreamVersion
+	})
+	return results, nil
+}
+
+// GetByCausationID is get stored events of aggregate with causation id in stream order (CausationDB interface)
+func (db *InMemoryDB) GetByCausationID(ctx context.Context, aggregateID, causationID string) ([]*StoredEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	results := make([]*StoredEvent, 0)
+	for _, storedEvent := range db.data[aggregateID] {
+		if storedEvent.Metadata.CausationID == causationID {
+			results = append(results, storedEvent.clone())
+		}
+	}
+	return results, nil
+}
+
+// Append is append stored events and outbox entries when stream version matches expected version, and return new stream version
+//
+// Each stored event is stamped with its own stream version and a store wide global position.
+func (db *InMemoryDB) Append(ctx context.Context, aggregateID string, expectedVersion int64, storedEvents []*StoredEvent, outbox []*OutboxEntry) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	version := int64(len(db.data[aggregateID]))
+	if err := checkExpectedVersion(aggregateID, expectedVersion, version); err != nil {
+		return version, err
+	}
+	for _, storedEvent := range storedEvents {
+		version++
+		db.position++
+		storedEvent.StreamVersion = version
+		storedEvent.GlobalPosition = db.position
+		stored := storedEvent.clone()
+		db.data[aggregateID] = append(db.data[aggregateID], stored)
+		db.all = append(db.all, stored)
+	}
+	for _, entry := range outbox {
+		db.outbox = append(db.outbox, entry.clone())
+	}
+	db.notifier.notify()
+	return version, nil
+}
+
+// PendingOutbox is get not dispatched outbox entries in commit order (OutboxDB interface)
+func (db *InMemoryDB) PendingOutbox(ctx context.Context, limit int64) ([]*OutboxEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	results := make([]*OutboxEntry, 0)
+	for _, entry := range db.outbox {
+		if int64(len(results)) >= limit {
+			break
+		}
+		if !entry.Dispatched {
+			results = append(results, entry.clone())
+		}
+	}
+	return results, nil
+}
+
+// MarkDispatched is mark outbox entry dispatched (OutboxDB interface)
+func (db *InMemoryDB) MarkDispatched(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, entry := range db.outbox {
+		if entry.ID == id {
+			entry.Dispatched = true
 		}
+	}
+	// drop dispatched entries from head
+	i := 0
+	for i < len(db.outbox) && db.outbox[i].Dispatched {
+		i++
+	}
+	db.outbox = db.outbox[i:]
+	return nil
+}
+
+// ReadAll is get stored events of all streams in commit order from global position
+func (db *InMemoryDB) ReadAll(ctx context.Context, position, limit int64) ([]*StoredEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	results := make([]*StoredEvent, 0)
+	i := sort.Search(len(db.all), func(i int) bool {
+		return db.all[i].GlobalPosition >= position
 	})
-	return results
+	for ; i < len(db.all) && int64(len(results)) < limit; i++ {
+		results = append(results, db.all[i].clone())
+	}
+	return results, nil
 }
 
-// Save is save stored event
-func (db *InMemoryDB) Save(e *StoredEvent) {
-	db.data[e.AggregateID] = append(db.data[e.AggregateID], e)
+// DeleteStream is physically delete stored events of aggregate
+func (db *InMemoryDB) DeleteStream(ctx context.Context, aggregateID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.data, aggregateID)
+	all := make([]*StoredEvent, 0, len(db.all))
+	for _, storedEvent := range db.all {
+		if storedEvent.AggregateID != aggregateID {
+			all = append(all, storedEvent)
+		}
+	}
+	db.all = all
+	return nil
+}
+
+// WaitCommit is channel closed on next commit
+func (db *InMemoryDB) WaitCommit() <-chan struct{} {
+	return db.notifier.wait()
+}
+
+// Clone is consistent point in time copy of database
+//
+// Reads on the copy are not affected by later writes to db, so several reads see the same state.
+func (db *InMemoryDB) Clone() *InMemoryDB {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	c := &InMemoryDB{
+		data:     make(map[string][]*StoredEvent, len(db.data)),
+		all:      make([]*StoredEvent, 0, len(db.all)),
+		position: db.position,
+		logger:   db.logger,
+	}
+	for _, storedEvent := range db.all {
+		stored := storedEvent.clone()
+		c.data[stored.AggregateID] = append(c.data[stored.AggregateID], stored)
+		c.all = append(c.all, stored)
+	}
+	for _, entry := range db.outbox {
+		c.outbox = append(c.outbox, entry.clone())
+	}
+	return c
 }
 
 // PersistenceContext is persistence interface
+//
+// Save stores messages to outbox in the same commit as events (alone when there are none), publish them with OutboxRelay.
+// DeleteAggregate physically removes the stream (hard delete),
+// ShredAggregate destroys the key of personal data so it becomes unreadable (crypto-shredding).
 type PersistenceContext interface {
-	ReplayAggregate(a AggregateContext) error
-	Save(a AggregateContext) error
+	ReplayAggregate(ctx context.Context, a AggregateContext) error
+	Save(ctx context.Context, a AggregateContext, expectedVersion int64, messages ...MessageContext) error
+	DeleteAggregate(ctx context.Context, aggregateID string) error
+	ShredAggregate(ctx context.Context, aggregateID string) error
 }
 
 // FakePersistence is fake persistence
 type FakePersistence struct {
-	db     *InMemoryDB
-	logger *zap.SugaredLogger
+	db        EventDB
+	snapshots SnapshotStore
+	policy    SnapshotPolicy
+	keys      KeyStore
+	codec     *PayloadCodec
+	events    Serializer
+	messages  Serializer
+	logger    *zap.SugaredLogger
 }
 
 // NewFakePersistence is new fake persistence
-func NewFakePersistence(db *InMemoryDB, logger *zap.SugaredLogger) *FakePersistence {
+func NewFakePersistence(db EventDB, logger *zap.SugaredLogger) *FakePersistence {
 	return &FakePersistence{
-		db:     db,
-		logger: logger,
+		db:       db,
+		events:   JSONSerializer{},
+		messages: JSONSerializer{},
+		logger:   logger,
 	}
 }
 
-// ReplayAggregate is replay aggregate
-func (p *FakePersistence) ReplayAggregate(a AggregateContext) error {
-	storedEvents := p.db.GetByID(a.AggregateID())
+// SetSnapshotStore is enable snapshots with store and policy
+func (p *FakePersistence) SetSnapshotStore(store SnapshotStore, policy SnapshotPolicy) {
+	p.snapshots = store
+	p.policy = policy
+}
+
+// SetSerializer is set serializer of event payloads (JSON by default)
+func (p *FakePersistence) SetSerializer(s Serializer) {
+	p.events = s
+}
+
+// SetMessageSerializer is set serializer of outbox messages (JSON by default)
+func (p *FakePersistence) SetMessageSerializer(s Serializer) {
+	p.messages = s
+}
+
+// SetKeyStore is enable encryption of personal data (PersonalDataContext) with per-aggregate keys
+func (p *FakePersistence) SetKeyStore(keys KeyStore) {
+	p.keys = keys
+}
+
+// SetPayloadCodec is enable compression and encryption at rest of payloads
+func (p *FakePersistence) SetPayloadCodec(codec *PayloadCodec) {
+	p.codec = codec
+}
+
+// ReplayAggregate is replay aggregate from latest snapshot if exists
+func (p *FakePersistence) ReplayAggregate(ctx context.Context, a AggregateContext) error {
+	if err := p.restoreSnapshot(ctx, a); err != nil {
+		return err
+	}
+	storedEvents, err := p.db.GetByID(ctx, a.AggregateID(), a.StreamVersion()+1)
+	if err != nil {
+		return err
+	}
+	if err := decodePayloads(ctx, p.codec, storedEvents); err != nil {
+		return err
+	}
+	if err := decryptPersonalData(ctx, p.keys, storedEvents); err != nil {
+		return err
+	}
 	if err := a.Replay(storedEvents); err != nil {
 		return err
 	}
 	return nil
 }
 
-// Save is save aggregate
-func (p *FakePersistence) Save(a AggregateContext) error {
-	for _, e := range a.UncommittedEvents() {
-		d, err := json.Marshal(e)
+// restoreSnapshot is restore aggregate state from latest snapshot of same schema version
+func (p *FakePersistence) restoreSnapshot(ctx context.Context, a AggregateContext) error {
+	sa, ok := a.(SnapshotAggregateContext)
+	if !ok || p.snapshots == nil {
+		return nil
+	}
+	snapshot, err := p.snapshots.LoadSnapshot(ctx, a.AggregateID())
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		return nil
+	}
+	if snapshot.SchemaVersion != sa.SnapshotSchemaVersion() {
+		p.logger.Infow("ignore snapshot of other schema version", "aggregateID", a.AggregateID(), "schemaVersion", snapshot.SchemaVersion)
+		return nil
+	}
+	// decode a copy, stores may share the loaded snapshot
+	decoded := *snapshot
+	if err := decodeSnapshot(ctx, p.codec, &decoded); err != nil {
+		p.logger.Warnw("ignore undecodable snapshot", "aggregateID", a.AggregateID(), "error", err)
+		return nil
+	}
+	if err := sa.UnmarshalSnapshot(decoded.Data); err != nil {
+		p.logger.Warnw("ignore broken snapshot", "aggregateID", a.AggregateID(), "error", err)
+		return nil
+	}
+	a.SetStreamVersion(snapshot.StreamVersion)
+	return nil
+}
+
+// TakeSnapshot is save snapshot of aggregate on demand
+func (p *FakePersistence) TakeSnapshot(ctx context.Context, a AggregateContext) error {
+	sa, ok := a.(SnapshotAggregateContext)
+	if !ok {
+		return errors.New("aggregate does not support snapshot")
+	}
+	if p.snapshots == nil {
+		return errors.New("snapshot store is not set")
+	}
+	d, err := sa.MarshalSnapshot()
+	if err != nil {
+		return err
+	}
+	snapshot := &Snapshot{
+		AggregateID:   a.AggregateID(),
+		StreamVersion: a.StreamVersion(),
+		SchemaVersion: sa.SnapshotSchemaVersion(),
+		Data:          d,
+	}
+	if p.codec != nil {
+		if err := p.codec.encodeSnapshot(ctx, snapshot); err != nil {
+			return err
+		}
+	}
+	return p.snapshots.SaveSnapshot(ctx, snapshot)
+}
+
+// Save is save aggregate and outbox messages when stream version matches expected version
+func (p *FakePersistence) Save(ctx context.Context, a AggregateContext, expectedVersion int64, messages ...MessageContext) error {
+	uncommittedEvents := a.UncommittedEvents()
+	if len(uncommittedEvents) == 0 && len(messages) == 0 {
+		return nil
+	}
+	storedEvents := make([]*StoredEvent, 0, len(uncommittedEvents))
+	for _, e := range uncommittedEvents {
+		payload := e
+		var personalData []byte
+		if pe, ok := e.(PersonalDataContext); ok && p.keys != nil {
+			d, err := encryptPersonalData(ctx, p.keys, a.AggregateID(), e.GetEventID(), pe.PersonalData())
+			if err != nil {
+				return err
+			}
+			payload = pe.WithoutPersonalData()
+			personalData = d
+		}
+		d, err := p.events.Marshal(payload)
 		if err != nil {
 			return err
 		}
 		storedEvent := &StoredEvent{
+			EventID:       e.GetEventID(),
 			AggregateID:   a.AggregateID(),
-			StreamVersion: a.StreamVersion(),
 			OccurredOn:    e.GetOccurredOn(),
 			EventType:     e.GetEventType(),
+			SchemaVersion: SchemaVersionOf(e),
+			ContentType:   p.events.ContentType(),
 			Data:          d,
+			PersonalData:  personalData,
+			Metadata:      a.EventMetadata(),
 		}
-		p.db.Save(storedEvent)
+		if p.codec != nil {
+			if err := p.codec.encode(ctx, storedEvent); err != nil {
+				return err
+			}
+		}
+		storedEvents = append(storedEvents, storedEvent)
+	}
+	outbox, err := newOutboxEntries(p.messages, messages)
+	if err != nil {
+		return err
+	}
+	version, err := p.db.Append(ctx, a.AggregateID(), expectedVersion, storedEvents, outbox)
+	if err != nil {
+		return err
+	}
+	for _, e := range uncommittedEvents {
 		a.CommitEvent(e)
 	}
-	a.SetStreamVersion(a.StreamVersion() + 1)
+	previousVersion := a.StreamVersion()
+	a.SetStreamVersion(version)
+	if p.snapshots != nil && p.policy != nil && p.policy.ShouldSnapshot(a, previousVersion) {
+		// snapshot is only optimization, so failure does not fail save
+		if err := p.TakeSnapshot(ctx, a); err != nil {
+			p.logger.Warnw("failed to take snapshot", "aggregateID", a.AggregateID(), "error", err)
+		}
+	}
+	return nil
+}
+
+// DeleteAggregate is physically delete stream and snapshot of aggregate
+func (p *FakePersistence) DeleteAggregate(ctx context.Context, aggregateID string) error {
+	if err := p.db.DeleteStream(ctx, aggregateID); err != nil {
+		return err
+	}
+	if p.snapshots != nil {
+		if err := p.snapshots.DeleteSnapshot(ctx, aggregateID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShredAggregate is destroy key of personal data and delete snapshot holding it in plain
+func (p *FakePersistence) ShredAggregate(ctx context.Context, aggregateID string) error {
+	if p.keys == nil {
+		return errors.New("key store is not set")
+	}
+	if err := p.keys.DestroyKey(ctx, aggregateID); err != nil {
+		return err
+	}
+	if p.snapshots != nil {
+		if err := p.snapshots.DeleteSnapshot(ctx, aggregateID); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // PersistenceQueryContext is persistence query interface
 type PersistenceQueryContext interface {
-	QueryEvents(id string, base, limit int64) ([]*StoredEvent, error)
+	QueryEvents(ctx context.Context, id string, base, limit int64) ([]*StoredEvent, error)
+	QueryAllEvents(ctx context.Context, position, limit int64) ([]*StoredEvent, error)
+	SubscribeAll(ctx context.Context, position int64, handler func(*StoredEvent) error) error
 }
 
 // FakePersistenceQuery is fake persistence query
 type FakePersistenceQuery struct {
-	db     *InMemoryDB
+	db     EventDB
+	keys   KeyStore
+	codec  *PayloadCodec
 	logger *zap.SugaredLogger
 }
 
 // NewFakePersistenceQuery is new fake persistence
-func NewFakePersistenceQuery(db *InMemoryDB, logger *zap.SugaredLogger) *FakePersistenceQuery {
+func NewFakePersistenceQuery(db EventDB, logger *zap.SugaredLogger) *FakePersistenceQuery {
 	return &FakePersistenceQuery{
 		db:     db,
 		logger: logger,
 	}
 }
 
+// SetKeyStore is enable decryption of personal data
+func (p *FakePersistenceQuery) SetKeyStore(keys KeyStore) {
+	p.keys = keys
+}
+
+// SetPayloadCodec is enable decoding of compressed and encrypted payloads
+func (p *FakePersistenceQuery) SetPayloadCodec(codec *PayloadCodec) {
+	p.codec = codec
+}
+
+// decode is decode payloads and personal data of stored events
+func (p *FakePersistenceQuery) decode(ctx context.Context, storedEvents []*StoredEvent) error {
+	if err := decodePayloads(ctx, p.codec, storedEvents); err != nil {
+		return err
+	}
+	return decryptPersonalData(ctx, p.keys, storedEvents)
+}
+
 // QueryEvents is query event by id and stream version
-func (p *FakePersistenceQuery) QueryEvents(id string, base, limit int64) ([]*StoredEvent, error) {
+func (p *FakePersistenceQuery) QueryEvents(ctx context.Context, id string, base, limit int64) ([]*StoredEvent, error) {
 	results := make([]*StoredEvent, 0)
-	storedEvents := p.db.GetByID(id)
+	storedEvents, err := p.db.GetByID(ctx, id, base)
+	if err != nil {
+		return nil, err
+	}
 	for _, storedEvent := range storedEvents {
 		if storedEvent.StreamVersion >= base && storedEvent.StreamVersion <= limit {
 			results = append(results, storedEvent)
 		}
 	}
+	if err := p.decode(ctx, results); err != nil {
+		return nil, err
+	}
 	return results, nil
 }
 
+// QueryAllEvents is query events of all streams in commit order from global position
+func (p *FakePersistenceQuery) QueryAllEvents(ctx context.Context, position, limit int64) ([]*StoredEvent, error) {
+	storedEvents, err := p.db.ReadAll(ctx, position, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.decode(ctx, storedEvents); err != nil {
+		return nil, err
+	}
+	return storedEvents, nil
+}
+
+// SubscribeAll is catch-up subscription of all streams from global position
+func (p *FakePersistenceQuery) SubscribeAll(ctx context.Context, position int64, handler func(*StoredEvent) error) error {
+	return SubscribeAll(ctx, p.db, position, func(storedEvent *StoredEvent) error {
+		if err := p.decode(ctx, []*StoredEvent{storedEvent}); err != nil {
+			return err
+		}
+		return handler(storedEvent)
+	})
+}
+
 // StoredEvent is stored event
+//
+// StreamVersion is 1-based position in the aggregate stream, GlobalPosition is 1-based position in the whole store.
+// SchemaVersion is schema version of Data (0 for events stored before versioning, read as 1),
+// ContentType is serializer of Data (empty for events stored before serializers, read as JSON),
+// Compression and KeyID are set when Data is compressed or encrypted at rest (PayloadCodec).
+// PersonalData is encrypted personal fields, PersonalFields is decrypted one (never stored, nil when shredded).
 type StoredEvent struct {
-	AggregateID   string
-	StreamVersion int64
-	OccurredOn    int64
-	EventType     string
-	Data          []byte
+	EventID        string
+	AggregateID    string
+	StreamVersion  int64
+	GlobalPosition int64
+	OccurredOn     int64
+	EventType      string
+	SchemaVersion  int
+	ContentType    string
+	Compression    string
+	KeyID          string
+	Data           []byte
+	PersonalData   []byte
+	PersonalFields map[string]string `json:"-"`
+	Metadata       EventMetadata
+}
+
+// clone is deep copy of stored event
+func (e *StoredEvent) clone() *StoredEvent {
+	c := *e
+	if e.Data != nil {
+		c.Data = append([]byte(nil), e.Data...)
+	}
+	if e.PersonalData != nil {
+		c.PersonalData = append([]byte(nil), e.PersonalData...)
+	}
+	if e.PersonalFields != nil {
+		c.PersonalFields = make(map[string]string, len(e.PersonalFields))
+		for k, v := range e.PersonalFields {
+			c.PersonalFields[k] = v
+		}
+	}
+	if e.Metadata.Headers != nil {
+		c.Metadata.Headers = make(map[string]string, len(e.Metadata.Headers))
+		for k, v := range e.Metadata.Headers {
+			c.Metadata.Headers[k] = v
+		}
+	}
+	return &c
 }
@@ -0,0 +1,186 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// readers change what they got, it must not reach the db
+func TestInMemoryDBConcurrentAppendAndRead(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryDB(zap.NewNop().Sugar())
+
+	const writers, appends = 10, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < appends; j++ {
+				storedEvents := newTestStoredEvents(fmt.Sprintf("agg-%d-%d", i, j), 1)
+				storedEvents[0].AggregateID = "shared"
+				storedEvents[0].Metadata.Headers = map[string]string{"writer": fmt.Sprint(i)}
+				outbox := []*OutboxEntry{{ID: fmt.Sprintf("m-%d-%d", i, j), MessageType: "TestMessage", Data: []byte("{}")}}
+				if _, err := db.Append(ctx, "shared", ExpectedVersionAny, storedEvents, outbox); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < appends; j++ {
+				storedEvents, err := db.GetByID(ctx, "shared", 0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, storedEvent := range storedEvents {
+					storedEvent.Data[0] = 'x'
+					storedEvent.Metadata.Headers["writer"] = "reader"
+				}
+				if _, err := db.ReadAll(ctx, 1, 20); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	storedEvents, err := db.GetByID(ctx, "shared", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storedEvents) != writers*appends {
+		t.Fatalf("got %d events, want %d", len(storedEvents), writers*appends)
+	}
+	for i, storedEvent := range storedEvents {
+		if storedEvent.StreamVersion != int64(i+1) {
+			t.Fatalf("event %d has stream version %d", i, storedEvent.StreamVersion)
+		}
+		if storedEvent.Data[0] != '{' || storedEvent.Metadata.Headers["writer"] == "reader" {
+			t.Fatalf("stored event %d was changed by reader", i)
+		}
+	}
+}
+
+func TestInMemoryDBConcurrentDeleteAndClone(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryDB(zap.NewNop().Sugar())
+
+	const streams = 50
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			aggregateID := fmt.Sprintf("agg-%d", i)
+			if _, err := db.Append(ctx, aggregateID, ExpectedVersionNoStream, newTestStoredEvents(aggregateID, 2), nil); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%2 == 0 {
+				if err := db.DeleteStream(ctx, aggregateID); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			// a clone is one point in time, so its stream reads and its global read agree
+			c := db.Clone()
+			all, err := c.ReadAll(ctx, 1, 1<<20)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			count := 0
+			for j := 0; j < streams; j++ {
+				storedEvents, err := c.GetByID(ctx, fmt.Sprintf("agg-%d", j), 0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				count += len(storedEvents)
+			}
+			if count != len(all) {
+				t.Errorf("clone has %d stream events but %d in global order", count, len(all))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := db.ReadAll(ctx, 1, 1<<20); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	all, err := db.ReadAll(ctx, 1, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != streams {
+		t.Fatalf("got %d events, want %d", len(all), streams)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].GlobalPosition <= all[i-1].GlobalPosition {
+			t.Fatalf("positions are not increasing at %d", i)
+		}
+	}
+}
+
+func TestInMemoryDBConcurrentOutbox(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryDB(zap.NewNop().Sugar())
+
+	const entries = 200
+	for i := 0; i < entries; i++ {
+		outbox := []*OutboxEntry{{ID: fmt.Sprintf("m-%d", i), MessageType: "TestMessage", Data: []byte("{}")}}
+		if _, err := db.Append(ctx, fmt.Sprintf("agg-%d", i), ExpectedVersionNoStream, newTestStoredEvents(fmt.Sprintf("agg-%d", i), 1), outbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 10; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < entries; i += 10 {
+				if err := db.MarkDispatched(ctx, fmt.Sprintf("m-%d", i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				pending, err := db.PendingOutbox(ctx, 50)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, entry := range pending {
+					entry.Dispatched = true
+				}
+				db.Clone()
+			}
+		}()
+	}
+	wg.Wait()
+
+	pending, err := db.PendingOutbox(ctx, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("got %d pending entries, want 0", len(pending))
+	}
+}
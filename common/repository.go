@@ -0,0 +1,61 @@
+package common
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrAggregateNotFound is aggregate has no stream error
+type ErrAggregateNotFound struct {
+	AggregateID string
+}
+
+// Error is error message (error interface)
+func (e *ErrAggregateNotFound) Error() string {
+	return fmt.Sprintf("aggregate %s not found", e.AggregateID)
+}
+
+// Repository is load-before-mutate repository of aggregate
+//
+// Load replays the aggregate, Save uses the loaded stream version as expected version,
+// so a concurrent writer between Load and Save is reported as ErrConcurrencyConflict.
+type Repository[T AggregateContext] struct {
+	persistence PersistenceContext
+	factory     func(aggregateID string) T
+}
+
+// NewRepository is new repository, factory is new empty aggregate
+func NewRepository[T AggregateContext](persistence PersistenceContext, factory func(aggregateID string) T) *Repository[T] {
+	return &Repository[T]{
+		persistence: persistence,
+		factory:     factory,
+	}
+}
+
+// New is new empty aggregate, saved as new stream
+func (r *Repository[T]) New(aggregateID string) T {
+	return r.factory(aggregateID)
+}
+
+// Load is replay aggregate, *ErrAggregateNotFound when stream not exists
+func (r *Repository[T]) Load(ctx context.Context, aggregateID string) (T, error) {
+	a := r.factory(aggregateID)
+	if err := r.persistence.ReplayAggregate(ctx, a); err != nil {
+		var zero T
+		return zero, err
+	}
+	if a.StreamVersion() == 0 {
+		var zero T
+		return zero, &ErrAggregateNotFound{AggregateID: aggregateID}
+	}
+	return a, nil
+}
+
+// Save is save uncommitted events of aggregate and outbox messages, expecting loaded stream version
+func (r *Repository[T]) Save(ctx context.Context, a T, messages ...MessageContext) error {
+	expectedVersion := a.StreamVersion()
+	if expectedVersion == 0 {
+		expectedVersion = ExpectedVersionNoStream
+	}
+	return r.persistence.Save(ctx, a, expectedVersion, messages...)
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// content types
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeGob     = "application/x-gob"
+	ContentTypeMsgpack = "application/x-msgpack"
+)
+
+// Serializer is payload serializer interface
+//
+// The content type is recorded with each stored event and message, so a stream written with several
+// serializers stays readable as long as each of them is registered (RegisterSerializer).
+// Other formats such as protobuf are added by implementing Serializer.
+type Serializer interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONSerializer is encoding/json serializer
+type JSONSerializer struct{}
+
+// ContentType is content type (Serializer interface)
+func (JSONSerializer) ContentType() string {
+	return ContentTypeJSON
+}
+
+// Marshal is marshal (Serializer interface)
+func (JSONSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal is unmarshal (Serializer interface)
+func (JSONSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobSerializer is encoding/gob serializer, compact but only readable from go
+type GobSerializer struct{}
+
+// ContentType is content type (Serializer interface)
+func (GobSerializer) ContentType() string {
+	return ContentTypeGob
+}
+
+// Marshal is marshal (Serializer interface)
+func (GobSerializer) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal is unmarshal (Serializer interface)
+func (GobSerializer) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+var (
+	serializersMu sync.RWMutex
+	serializers   = map[string]Serializer{
+		ContentTypeJSON:    JSONSerializer{},
+		ContentTypeGob:     GobSerializer{},
+		ContentTypeMsgpack: MsgpackSerializer{},
+	}
+)
+
+// RegisterSerializer is register serializer by its content type
+func RegisterSerializer(s Serializer) {
+	serializersMu.Lock()
+	defer serializersMu.Unlock()
+
+	serializers[s.ContentType()] = s
+}
+
+// SerializerFor is serializer of content type, empty content type (written before serializers) is JSON
+func SerializerFor(contentType string) (Serializer, error) {
+	serializersMu.RLock()
+	defer serializersMu.RUnlock()
+
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+	s, ok := serializers[contentType]
+	if !ok {
+		return nil, errors.Errorf("unknown content type %s", contentType)
+	}
+	return s, nil
+}
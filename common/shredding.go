@@ -0,0 +1,164 @@
+package common
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrKeyNotFound is key not exists or destroyed error
+var ErrKeyNotFound = errors.New("key not found")
+
+// PersonalDataContext is event with personal data interface
+//
+// Personal fields are stored encrypted with a per-aggregate key apart from the payload,
+// so destroying the key (crypto-shredding) makes them unreadable while the rest of the event still replays.
+type PersonalDataContext interface {
+	PersonalData() map[string]string
+	WithoutPersonalData() EventContext
+	RestorePersonalData(fields map[string]string)
+}
+
+// KeyStore is per-aggregate encryption key store interface
+type KeyStore interface {
+	// Key is get key of aggregate, creating one when create is true, ErrKeyNotFound when not exists
+	Key(ctx context.Context, aggregateID string, create bool) ([]byte, error)
+	DestroyKey(ctx context.Context, aggregateID string) error
+}
+
+// InMemoryKeyStore is in memory key store
+type InMemoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// NewInMemoryKeyStore is new in memory key store
+func NewInMemoryKeyStore() *InMemoryKeyStore {
+	return &InMemoryKeyStore{
+		keys: make(map[string][]byte),
+	}
+}
+
+// Key is get key of aggregate (KeyStore interface)
+func (s *InMemoryKeyStore) Key(ctx context.Context, aggregateID string, create bool) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.keys[aggregateID]; ok {
+		return key, nil
+	}
+	if !create {
+		return nil, ErrKeyNotFound
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.Wrap(err, "鍵の生成に失敗しました")
+	}
+	s.keys[aggregateID] = key
+	return key, nil
+}
+
+// DestroyKey is destroy key of aggregate (KeyStore interface)
+func (s *InMemoryKeyStore) DestroyKey(ctx context.Context, aggregateID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, aggregateID)
+	return nil
+}
+
+// personalDataAAD is additional data binding encrypted personal fields to their aggregate and event
+func personalDataAAD(aggregateID, eventID string) []byte {
+	return []byte(aggregateID + "/" + eventID + "/personal")
+}
+
+// encryptPersonalData is encrypt personal fields of event with key of aggregate
+func encryptPersonalData(ctx context.Context, keys KeyStore, aggregateID, eventID string, fields map[string]string) ([]byte, error) {
+	key, err := keys.Key(ctx, aggregateID, true)
+	if err != nil {
+		return nil, err
+	}
+	d, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return sealAESGCM(key, d, personalDataAAD(aggregateID, eventID))
+}
+
+// decryptPersonalData is decrypt personal fields of stored events, left nil when key was destroyed
+func decryptPersonalData(ctx context.Context, keys KeyStore, storedEvents []*StoredEvent) error {
+	if keys == nil {
+		return nil
+	}
+	for _, storedEvent := range storedEvents {
+		if len(storedEvent.PersonalData) == 0 {
+			continue
+		}
+		key, err := keys.Key(ctx, storedEvent.AggregateID, false)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		d, err := openAESGCM(key, storedEvent.PersonalData, personalDataAAD(storedEvent.AggregateID, storedEvent.EventID))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(d, &storedEvent.PersonalFields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealAESGCM is encrypt with AES-GCM, nonce is prepended to ciphertext
+func sealAESGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// openAESGCM is decrypt ciphertext of sealAESGCM
+func openAESGCM(key, ciphertext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], additionalData)
+	if err != nil {
+		return nil, errors.Wrap(err, "復号に失敗しました")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// Snapshot is aggregate state at stream version
+//
+// Compression and KeyID are set when Data is encoded by PayloadCodec.
+type Snapshot struct {
+	AggregateID   string
+	StreamVersion int64
+	SchemaVersion int
+	Compression   string
+	KeyID         string
+	Data          []byte
+}
+
+// SnapshotAggregateContext is aggregate with snapshot interface
+//
+// SnapshotSchemaVersion must be bumped whenever the shape of the snapshot data changes,
+// snapshots of other schema versions are ignored and the aggregate is fully replayed.
+type SnapshotAggregateContext interface {
+	AggregateContext
+	SnapshotSchemaVersion() int
+	MarshalSnapshot() ([]byte, error)
+	UnmarshalSnapshot(data []byte) error
+}
+
+// SnapshotStore is snapshot store interface
+type SnapshotStore interface {
+	// LoadSnapshot is load latest snapshot, nil when not exists
+	LoadSnapshot(ctx context.Context, aggregateID string) (*Snapshot, error)
+	SaveSnapshot(ctx context.Context, s *Snapshot) error
+	DeleteSnapshot(ctx context.Context, aggregateID string) error
+}
+
+// SnapshotPolicy is snapshot policy interface
+type SnapshotPolicy interface {
+	ShouldSnapshot(a AggregateContext, previousVersion int64) bool
+}
+
+// everyNEvents is snapshot policy every n events
+type everyNEvents struct {
+	n int64
+}
+
+// EveryNEvents is snapshot policy taking snapshot each time stream version crosses multiple of n
+func EveryNEvents(n int64) SnapshotPolicy {
+	return &everyNEvents{n: n}
+}
+
+// ShouldSnapshot is should take snapshot (SnapshotPolicy interface)
+func (p *everyNEvents) ShouldSnapshot(a AggregateContext, previousVersion int64) bool {
+	if p.n <= 0 {
+		return false
+	}
+	return a.StreamVersion()/p.n > previousVersion/p.n
+}
+
+// onDemand is snapshot policy only on demand
+type onDemand struct{}
+
+// OnDemand is snapshot policy never taking snapshot automatically, use FakePersistence.TakeSnapshot
+func OnDemand() SnapshotPolicy {
+	return &onDemand{}
+}
+
+// ShouldSnapshot is should take snapshot (SnapshotPolicy interface)
+func (p *onDemand) ShouldSnapshot(a AggregateContext, previousVersion int64) bool {
+	return false
+}
+
+// InMemorySnapshotStore is in memory snapshot store
+type InMemorySnapshotStore struct {
+	mu   sync.Mutex
+	data map[string]*Snapshot
+}
+
+// NewInMemorySnapshotStore is new in memory snapshot store
+func NewInMemorySnapshotStore() *InMemorySnapshotStore {
+	return &InMemorySnapshotStore{
+		data: make(map[string]*Snapshot),
+	}
+}
+
+// LoadSnapshot is load latest snapshot (SnapshotStore interface)
+func (s *InMemorySnapshotStore) LoadSnapshot(ctx context.Context, aggregateID string) (*Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data[aggregateID], nil
+}
+
+// SaveSnapshot is save snapshot, older one than stored is ignored (SnapshotStore interface)
+func (s *InMemorySnapshotStore) SaveSnapshot(ctx context.Context, snapshot *Snapshot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.data[snapshot.AggregateID]; ok && current.StreamVersion > snapshot.StreamVersion {
+		return nil
+	}
+	s.data[snapshot.AggregateID] = snapshot
+	return nil
+}
+
+// DeleteSnapshot is delete snapshot (SnapshotStore interface)
+func (s *InMemorySnapshotStore) DeleteSnapshot(ctx context.Context, aggregateID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, aggregateID)
+	return nil
+}
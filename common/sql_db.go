@@ -0,0 +1,345 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// sqlMigrations is schema migrations, index + 1 is schema version
+//
+// Statements are written for SQLite.
+var sqlMigrations = []string{
+	`CREATE TABLE events (
+		position INTEGER PRIMARY KEY AUTOINCREMENT,
+		aggregate_id TEXT NOT NULL,
+		stream_version INTEGER NOT NULL,
+		occurred_on INTEGER NOT NULL,
+		event_type TEXT NOT NULL,
+		data BLOB NOT NULL,
+		UNIQUE (aggregate_id, stream_version)
+	)`,
+	`CREATE TABLE snapshots (
+		aggregate_id TEXT PRIMARY KEY,
+		stream_version INTEGER NOT NULL,
+		schema_version INTEGER NOT NULL,
+		data BLOB NOT NULL
+	)`,
+	`ALTER TABLE events ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 1`,
+	`ALTER TABLE events ADD COLUMN event_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE events ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE outbox (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		message_type TEXT NOT NULL,
+		data BLOB NOT NULL,
+		created_at INTEGER NOT NULL,
+		dispatched INTEGER NOT NULL DEFAULT 0
+	)`,
+	`ALTER TABLE events ADD COLUMN personal_data BLOB`,
+	`ALTER TABLE events ADD COLUMN content_type TEXT NOT NULL DEFAULT 'application/json'`,
+	`ALTER TABLE outbox ADD COLUMN content_type TEXT NOT NULL DEFAULT 'application/json'`,
+	`ALTER TABLE events ADD COLUMN compression TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE events ADD COLUMN key_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE events ADD COLUMN causation_id TEXT NOT NULL DEFAULT ''`,
+	`UPDATE events SET causation_id = COALESCE(json_extract(metadata, '$.CausationID'), '')`,
+	`CREATE INDEX events_causation ON events (aggregate_id, causation_id)`,
+	`ALTER TABLE snapshots ADD COLUMN compression TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE snapshots ADD COLUMN key_id TEXT NOT NULL DEFAULT ''`,
+}
+
+// SQLDB is event database on database/sql
+//
+// Global positions come from an autoincrement key, so concurrent writers must be serialized by the database
+// (as SQLite does) for ReadAll to see commits in position order.
+type SQLDB struct {
+	db       *sql.DB
+	notifier commitNotifier
+	logger   *zap.SugaredLogger
+}
+
+// NewSQLDB is new sql db, and migrate schema
+func NewSQLDB(ctx context.Context, db *sql.DB, logger *zap.SugaredLogger) (*SQLDB, error) {
+	s := &SQLDB{
+		db:     db,
+		logger: logger,
+	}
+	if err := s.Migrate(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Migrate is apply schema migrations not yet applied
+func (s *SQLDB) Migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return errors.Wrap(err, "マイグレーションテーブルの作成に失敗しました")
+	}
+	var current int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return errors.Wrap(err, "スキーマバージョンの取得に失敗しました")
+	}
+	for i := current; i < len(sqlMigrations); i++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sqlMigrations[i]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "スキーマバージョン%dのマイグレーションに失敗しました", i+1)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "スキーマバージョン%dのマイグレーションに失敗しました", i+1)
+		}
+		if err := tx.Commit(); err != nil {
+			return errors.Wrapf(err, "スキーマバージョン%dのマイグレーションに失敗しました", i+1)
+		}
+		s.logger.Infow("migrate schema", "version", i+1)
+	}
+	return nil
+}
+
+// GetByID is get stored events by id from base stream version
+func (s *SQLDB) GetByID(ctx context.Context, id string, base int64) ([]*StoredEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT position, event_id, aggregate_id, stream_version, occurred_on, event_type, schema_version, content_type, compression, key_id, data, personal_data, metadata FROM events WHERE aggregate_id = ? AND stream_version >= ? ORDER BY stream_version`, id, base)
+	if err != nil {
+		return nil, err
+	}
+	return scanStoredEvents(rows)
+}
+
+// GetByCausationID is get stored events of aggregate with causation id in stream order (CausationDB interface)
+func (s *SQLDB) GetByCausationID(ctx context.Context, aggregateID, causationID string) ([]*StoredEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT position, event_id, aggregate_id, stream_version, occurred_on, event_type, schema_version, content_type, compression, key_id, data, personal_data, metadata FROM events WHERE aggregate_id = ? AND causation_id = ? ORDER BY stream_version`, aggregateID, causationID)
+	if err != nil {
+		return nil, err
+	}
+	return scanStoredEvents(rows)
+}
+
+// PruneCausations is forget causations of commands occurred before (unix nano) (CausationPruner interface)
+func (s *SQLDB) PruneCausations(ctx context.Context, before int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE events SET causation_id = '' WHERE causation_id != '' AND (aggregate_id, causation_id) IN (SELECT aggregate_id, causation_id FROM events WHERE causation_id != '' GROUP BY aggregate_id, causation_id HAVING MAX(occurred_on) < ?)`, before)
+	if err != nil {
+		return errors.Wrap(err, "因果IDの削除に失敗しました")
+	}
+	return nil
+}
+
+// scanStoredEvents is scan rows to stored events, and close rows
+func scanStoredEvents(rows *sql.Rows) ([]*StoredEvent, error) {
+	defer rows.Close()
+
+	results := make([]*StoredEvent, 0)
+	for rows.Next() {
+		var storedEvent StoredEvent
+		var metadata string
+		if err := rows.Scan(&storedEvent.GlobalPosition, &storedEvent.EventID, &storedEvent.AggregateID, &storedEvent.StreamVersion, &storedEvent.OccurredOn, &storedEvent.EventType, &storedEvent.SchemaVersion, &storedEvent.ContentType, &storedEvent.Compression, &storedEvent.KeyID, &storedEvent.Data, &storedEvent.PersonalData, &metadata); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(metadata), &storedEvent.Metadata); err != nil {
+			return nil, err
+		}
+		results = append(results, &storedEvent)
+	}
+	return results, rows.Err()
+}
+
+// Append is append stored events and outbox entries in one transaction when stream version matches expected version,
+// and return new stream version
+//
+// The unique (aggregate_id, stream_version) constraint rejects a concurrent append that passed the version check.
+func (s *SQLDB) Append(ctx context.Context, aggregateID string, expectedVersion int64, storedEvents []*StoredEvent, outbox []*OutboxEntry) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	// write first so the transaction takes the write lock before reading the version (as BEGIN IMMEDIATE),
+	// otherwise a concurrent writer fails to upgrade its read lock with SQLITE_BUSY instead of waiting
+	if _, err := tx.ExecContext(ctx, `UPDATE events SET stream_version = stream_version WHERE 0`); err != nil {
+		tx.Rollback()
+		return s.conflictOr(ctx, aggregateID, expectedVersion, err)
+	}
+	version, err := streamVersion(ctx, tx, aggregateID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := checkExpectedVersion(aggregateID, expectedVersion, version); err != nil {
+		tx.Rollback()
+		return version, err
+	}
+	for _, storedEvent := range storedEvents {
+		version++
+		storedEvent.StreamVersion = version
+		metadata, err := json.Marshal(storedEvent.Metadata)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO events (event_id, aggregate_id, stream_version, occurred_on, event_type, schema_version, content_type, compression, key_id, data, personal_data, metadata, causation_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			storedEvent.EventID, aggregateID, storedEvent.StreamVersion, storedEvent.OccurredOn, storedEvent.EventType, storedEvent.SchemaVersion, contentTypeOrJSON(storedEvent.ContentType), storedEvent.Compression, storedEvent.KeyID, storedEvent.Data, storedEvent.PersonalData, string(metadata), storedEvent.Metadata.CausationID,
+		)
+		if err != nil {
+			tx.Rollback()
+			return s.conflictOr(ctx, aggregateID, expectedVersion, err)
+		}
+		position, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		storedEvent.GlobalPosition = position
+	}
+	for _, entry := range outbox {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO outbox (id, message_type, content_type, data, created_at) VALUES (?, ?, ?, ?, ?)`,
+			entry.ID, entry.MessageType, contentTypeOrJSON(entry.ContentType), entry.Data, entry.CreatedAt,
+		); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return s.conflictOr(ctx, aggregateID, expectedVersion, err)
+	}
+	s.notifier.notify()
+	return version, nil
+}
+
+// ReadAll is get stored events of all streams in commit order from global position
+func (s *SQLDB) ReadAll(ctx context.Context, position, limit int64) ([]*StoredEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT position, event_id, aggregate_id, stream_version, occurred_on, event_type, schema_version, content_type, compression, key_id, data, personal_data, metadata FROM events WHERE position >= ? ORDER BY position LIMIT ?`, position, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanStoredEvents(rows)
+}
+
+// DeleteStream is physically delete stored events of aggregate, positions are never reused (autoincrement)
+func (s *SQLDB) DeleteStream(ctx context.Context, aggregateID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM events WHERE aggregate_id = ?`, aggregateID)
+	return err
+}
+
+// WaitCommit is channel closed on next commit by this process
+func (s *SQLDB) WaitCommit() <-chan struct{} {
+	return s.notifier.wait()
+}
+
+// conflictOr is return concurrency conflict when stream was changed by other writer or err is lock or unique violation, otherwise err
+func (s *SQLDB) conflictOr(ctx context.Context, aggregateID string, expectedVersion int64, err error) (int64, error) {
+	version, verr := streamVersion(ctx, s.db, aggregateID)
+	if verr == nil {
+		if cerr := checkExpectedVersion(aggregateID, expectedVersion, version); cerr != nil {
+			return version, cerr
+		}
+	}
+	if isSQLConflict(err) {
+		// the other writer may not have committed yet, so the version read above can still be the expected one
+		return version, &ErrConcurrencyConflict{
+			AggregateID:     aggregateID,
+			ExpectedVersion: expectedVersion,
+			ActualVersion:   version,
+		}
+	}
+	if verr != nil {
+		return 0, err
+	}
+	return version, err
+}
+
+// isSQLConflict is err is lock contention or unique violation of concurrent writer (SQLite error messages)
+func isSQLConflict(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{"SQLITE_BUSY", "database is locked", "UNIQUE constraint failed"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingOutbox is get not dispatched outbox entries in commit order (OutboxDB interface)
+func (s *SQLDB) PendingOutbox(ctx context.Context, limit int64) ([]*OutboxEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, message_type, content_type, data, created_at FROM outbox WHERE dispatched = 0 ORDER BY seq LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*OutboxEntry, 0)
+	for rows.Next() {
+		var entry OutboxEntry
+		if err := rows.Scan(&entry.ID, &entry.MessageType, &entry.ContentType, &entry.Data, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, &entry)
+	}
+	return results, rows.Err()
+}
+
+// MarkDispatched is mark outbox entry dispatched (OutboxDB interface)
+func (s *SQLDB) MarkDispatched(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE outbox SET dispatched = 1 WHERE id = ?`, id)
+	return err
+}
+
+// LoadSnapshot is load latest snapshot (SnapshotStore interface)
+func (s *SQLDB) LoadSnapshot(ctx context.Context, aggregateID string) (*Snapshot, error) {
+	snapshot := &Snapshot{AggregateID: aggregateID}
+	err := s.db.QueryRowContext(ctx, `SELECT stream_version, schema_version, compression, key_id, data FROM snapshots WHERE aggregate_id = ?`, aggregateID).
+		Scan(&snapshot.StreamVersion, &snapshot.SchemaVersion, &snapshot.Compression, &snapshot.KeyID, &snapshot.Data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// SaveSnapshot is save snapshot, older one than stored is ignored (SnapshotStore interface)
+func (s *SQLDB) SaveSnapshot(ctx context.Context, snapshot *Snapshot) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO snapshots (aggregate_id, stream_version, schema_version, compression, key_id, data) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (aggregate_id) DO UPDATE SET stream_version = excluded.stream_version, schema_version = excluded.schema_version, compression = excluded.compression, key_id = excluded.key_id, data = excluded.data
+		WHERE excluded.stream_version >= snapshots.stream_version`,
+		snapshot.AggregateID, snapshot.StreamVersion, snapshot.SchemaVersion, snapshot.Compression, snapshot.KeyID, snapshot.Data,
+	)
+	return err
+}
+
+// DeleteSnapshot is delete snapshot (SnapshotStore interface)
+func (s *SQLDB) DeleteSnapshot(ctx context.Context, aggregateID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM snapshots WHERE aggregate_id = ?`, aggregateID)
+	return err
+}
+
+// sqlQueryer is common interface of *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// streamVersion is current stream version of aggregate
+func streamVersion(ctx context.Context, q sqlQueryer, aggregateID string) (int64, error) {
+	var version int64
+	if err := q.QueryRowContext(ctx, `SELECT COALESCE(MAX(stream_version), 0) FROM events WHERE aggregate_id = ?`, aggregateID).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// contentTypeOrJSON is content type, JSON when empty
+func contentTypeOrJSON(contentType string) string {
+	if contentType == "" {
+		return ContentTypeJSON
+	}
+	return contentType
+}
@@ -0,0 +1,197 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+func openTestSQLDB(t *testing.T) (*SQLDB, *sql.DB) {
+	return openTestSQLDBWithPragma(t, "busy_timeout(5000)")
+}
+
+func openTestSQLDBWithPragma(t *testing.T, pragma string) (*SQLDB, *sql.DB) {
+	t.Helper()
+	raw, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "events.db")+"?_pragma="+pragma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { raw.Close() })
+	db, err := NewSQLDB(context.Background(), raw, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, raw
+}
+
+func TestSQLDBMigrate(t *testing.T) {
+	ctx := context.Background()
+	db, raw := openTestSQLDB(t)
+
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := raw.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(sqlMigrations) {
+		t.Fatalf("applied %d migrations, want %d", count, len(sqlMigrations))
+	}
+}
+
+func TestSQLDBOptimisticConcurrency(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openTestSQLDB(t)
+
+	version, err := db.Append(ctx, "a", ExpectedVersionNoStream, newTestStoredEvents("a", 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("version is %d, want 2", version)
+	}
+	_, err = db.Append(ctx, "a", 1, newTestStoredEvents("a-stale", 1), nil)
+	conflict, ok := err.(*ErrConcurrencyConflict)
+	if !ok {
+		t.Fatalf("got %v, want concurrency conflict", err)
+	}
+	if conflict.ActualVersion != 2 {
+		t.Fatalf("actual version is %d, want 2", conflict.ActualVersion)
+	}
+	if _, err := db.Append(ctx, "a", 2, newTestStoredEvents("a-next", 1), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLDBConcurrentWriters(t *testing.T) {
+	// without busy timeout lock contention fails immediately, and must still be a conflict
+	for _, pragma := range []string{"busy_timeout(5000)", "journal_mode(WAL)"} {
+		t.Run(pragma, func(t *testing.T) {
+			testSQLDBConcurrentWriters(t, pragma)
+		})
+	}
+}
+
+func testSQLDBConcurrentWriters(t *testing.T, pragma string) {
+	ctx := context.Background()
+	db, _ := openTestSQLDBWithPragma(t, pragma)
+
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = db.Append(ctx, "a", ExpectedVersionNoStream, newTestStoredEvents(fmt.Sprintf("a-%d", i), 1), nil)
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, err := range errs {
+		switch err.(type) {
+		case nil:
+			succeeded++
+		case *ErrConcurrencyConflict:
+		default:
+			t.Errorf("got %v, want concurrency conflict", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d writers succeeded, want 1", succeeded)
+	}
+}
+
+func TestSQLDBConcurrentStreams(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openTestSQLDB(t)
+
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			aggregateID := fmt.Sprintf("agg-%d", i)
+			_, errs[i] = db.Append(ctx, aggregateID, ExpectedVersionNoStream, newTestStoredEvents(aggregateID, 1), nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	storedEvents, err := db.ReadAll(ctx, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storedEvents) != writers {
+		t.Fatalf("got %d events, want %d", len(storedEvents), writers)
+	}
+}
+
+func TestSQLDBReadAll(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openTestSQLDB(t)
+
+	for _, aggregateID := range []string{"a", "b", "c"} {
+		if _, err := db.Append(ctx, aggregateID, ExpectedVersionNoStream, newTestStoredEvents(aggregateID, 2), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DeleteStream(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	storedEvents, err := db.ReadAll(ctx, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{2, 5, 6}
+	if len(storedEvents) != len(want) {
+		t.Fatalf("got %d events, want %d", len(storedEvents), len(want))
+	}
+	for i, storedEvent := range storedEvents {
+		if storedEvent.GlobalPosition != want[i] {
+			t.Fatalf("event %d has position %d, want %d", i, storedEvent.GlobalPosition, want[i])
+		}
+	}
+}
+
+func TestSQLDBSnapshots(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openTestSQLDB(t)
+
+	if snapshot, err := db.LoadSnapshot(ctx, "a"); err != nil || snapshot != nil {
+		t.Fatalf("got %v %v, want no snapshot", snapshot, err)
+	}
+	if err := db.SaveSnapshot(ctx, &Snapshot{AggregateID: "a", StreamVersion: 5, SchemaVersion: 1, Compression: CompressionGzip, KeyID: "k1", Data: []byte("v5")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveSnapshot(ctx, &Snapshot{AggregateID: "a", StreamVersion: 3, SchemaVersion: 1, Data: []byte("v3")}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := db.LoadSnapshot(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.StreamVersion != 5 || snapshot.Compression != CompressionGzip || snapshot.KeyID != "k1" || string(snapshot.Data) != "v5" {
+		t.Fatalf("got %+v, want snapshot of version 5", snapshot)
+	}
+	if err := db.DeleteSnapshot(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot, err := db.LoadSnapshot(ctx, "a"); err != nil || snapshot != nil {
+		t.Fatalf("got %v %v, want deleted", snapshot, err)
+	}
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// subscription settings
+const (
+	subscriptionBatchSize    int64 = 512
+	subscriptionPollInterval       = time.Second
+)
+
+// commitNotifier is broadcast of commits
+type commitNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait is channel closed on next notify
+func (n *commitNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+// notify is wake up waiters
+func (n *commitNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// SubscribeAll is catch-up subscription of all streams
+//
+// Handler is called for every event from global position in commit order, first for history and then for live events,
+// until ctx is done or handler returns error. The db is also polled so commits by other processes are picked up.
+func SubscribeAll(ctx context.Context, db EventDB, position int64, handler func(*StoredEvent) error) error {
+	if position < 1 {
+		position = 1
+	}
+	ticker := time.NewTicker(subscriptionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// take wait channel before read, so a commit between read and wait is not missed
+		committed := db.WaitCommit()
+		storedEvents, err := db.ReadAll(ctx, position, subscriptionBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, storedEvent := range storedEvents {
+			if storedEvent.GlobalPosition < position {
+				continue
+			}
+			if err := handler(storedEvent); err != nil {
+				return err
+			}
+			position = storedEvent.GlobalPosition + 1
+		}
+		if int64(len(storedEvents)) == subscriptionBatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-committed:
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSubscribeAllHandsOffFromHistoryToLive(t *testing.T) {
+	for name, open := range map[string]func(t *testing.T) EventDB{
+		"memory": func(t *testing.T) EventDB { return NewInMemoryDB(zap.NewNop().Sugar()) },
+		"file":   func(t *testing.T) EventDB { return openTestFileDB(t, t.TempDir(), 0) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db := open(t)
+
+			// history is more than two batches, so catch-up reads several pages while writers append
+			const histories, writers, appends = 112, 4, 50
+			for i := 0; i < histories; i++ {
+				aggregateID := fmt.Sprintf("history-%d", i)
+				if _, err := db.Append(ctx, aggregateID, ExpectedVersionNoStream, newTestStoredEvents(aggregateID, 10), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			const checkpoint = subscriptionBatchSize - 12
+			const last = histories*10 + writers*appends*2
+
+			var seen []int64
+			done := make(chan error, 1)
+			go func() {
+				done <- SubscribeAll(ctx, db, checkpoint, func(storedEvent *StoredEvent) error {
+					seen = append(seen, storedEvent.GlobalPosition)
+					if storedEvent.GlobalPosition == last {
+						cancel()
+					}
+					return nil
+				})
+			}()
+
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < appends; i++ {
+						aggregateID := fmt.Sprintf("live-%d-%d", w, i)
+						if _, err := db.Append(context.Background(), aggregateID, ExpectedVersionNoStream, newTestStoredEvents(aggregateID, 2), nil); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			if err := <-done; err != context.Canceled {
+				t.Fatalf("got %v, want %v", err, context.Canceled)
+			}
+			if want := int(last - checkpoint + 1); len(seen) != want {
+				t.Fatalf("got %d events, want %d", len(seen), want)
+			}
+			for i, position := range seen {
+				if want := checkpoint + int64(i); position != want {
+					t.Fatalf("got position %d at %d, want %d", position, i, want)
+				}
+			}
+		})
+	}
+}
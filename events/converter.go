@@ -1,33 +1,43 @@
 package events
 
 import (
-	"encoding/json"
 	"errors"
 
 	"github.com/lightstaff/go-dddcqrses/common"
 )
 
-// EventConverter is event to type
-func EventConverter(eventType string, data []byte) (common.EventContext, error) {
-	switch eventType {
+// EventConverter is stored event to type, decoding payload by its content type,
+// upcasting it to current schema version and restoring personal fields
+func EventConverter(storedEvent *common.StoredEvent) (common.EventContext, error) {
+	var e common.EventContext
+	switch storedEvent.EventType {
 	case EventTypeTodoRegistered:
-		var e TodoRegistered
-		if err := json.Unmarshal(data, &e); err != nil {
-			return nil, err
-		}
-		return &e, nil
+		e = &TodoRegistered{}
 	case EventTypeTodoMessageChanged:
-		var e TodoMessageChanged
-		if err := json.Unmarshal(data, &e); err != nil {
-			return nil, err
-		}
-		return &e, nil
+		e = &TodoMessageChanged{}
 	case EventTypeTodoCompleted:
-		var e TodoCompleted
-		if err := json.Unmarshal(data, &e); err != nil {
-			return nil, err
-		}
-		return &e, nil
+		e = &TodoCompleted{}
+	case EventTypeTodoDeleted:
+		e = &TodoDeleted{}
+	case EventTypeTodoShredded:
+		e = &TodoShredded{}
+	default:
+		return nil, errors.New("unknown event")
 	}
-	return nil, errors.New("unknown event")
+	serializer, err := common.SerializerFor(storedEvent.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	data, err := Upcast(storedEvent.EventType, storedEvent.ContentType, storedEvent.SchemaVersion, common.SchemaVersionOf(e), storedEvent.Data)
+	if err != nil {
+		return nil, err
+	}
+	if err := serializer.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	// personal fields are left empty when the key of the aggregate was destroyed
+	if p, ok := e.(common.PersonalDataContext); ok && storedEvent.PersonalFields != nil {
+		p.RestorePersonalData(storedEvent.PersonalFields)
+	}
+	return e, nil
 }
@@ -11,20 +11,51 @@ const (
 	EventTypeTodoRegistered     = "TodoRegistered"
 	EventTypeTodoMessageChanged = "TodoMessageChanged"
 	EventTypeTodoCompleted      = "TodoCompleted"
+	EventTypeTodoDeleted        = "TodoDeleted"
+	EventTypeTodoShredded       = "TodoShredded"
 )
 
+// event schema versions, bump and register upcaster (RegisterUpcaster) when payload shape changes
+const (
+	SchemaVersionTodoRegistered     = 2
+	SchemaVersionTodoMessageChanged = 1
+	SchemaVersionTodoCompleted      = 1
+	SchemaVersionTodoDeleted        = 1
+	SchemaVersionTodoShredded       = 1
+)
+
+// personal data fields
+const personalFieldMessage = "Message"
+
+func init() {
+	// v2 TodoRegistered adds Owner, todos registered before it have no owner
+	RegisterUpcaster(EventTypeTodoRegistered, 1, nil)
+}
+
+// TodoEvents is prototypes of all todo events, for checking that handlers cover them (common.EventRouter.MustHandle)
+func TodoEvents() []common.EventContext {
+	return []common.EventContext{
+		&TodoRegistered{},
+		&TodoMessageChanged{},
+		&TodoCompleted{},
+		&TodoDeleted{},
+		&TodoShredded{},
+	}
+}
+
 // TodoRegistered is todo registered event
 type TodoRegistered struct {
 	EventID     string
 	EventType   string
 	OccurredOn  int64
 	AggregateID string
+	Owner       string
 	Message     string
 	Completed   bool
 }
 
-// NewTodoRegistered is new todo registered
-func NewTodoRegistered(aggregateID, message string, completed bool) (*TodoRegistered, error) {
+// NewTodoRegistered is new todo registered, owner is principal id registering it
+func NewTodoRegistered(aggregateID, owner, message string, completed bool) (*TodoRegistered, error) {
 	eventID, err := common.NewEventID()
 	if err != nil {
 		return nil, err
@@ -34,6 +65,7 @@ func NewTodoRegistered(aggregateID, message string, completed bool) (*TodoRegist
 		EventType:   EventTypeTodoRegistered,
 		OccurredOn:  time.Now().UnixNano(),
 		AggregateID: aggregateID,
+		Owner:       owner,
 		Message:     message,
 		Completed:   completed,
 	}, nil
@@ -54,6 +86,28 @@ func (e *TodoRegistered) GetOccurredOn() int64 {
 	return e.OccurredOn
 }
 
+// GetSchemaVersion is get schema version (common.SchemaVersionContext interface)
+func (e *TodoRegistered) GetSchemaVersion() int {
+	return SchemaVersionTodoRegistered
+}
+
+// PersonalData is personal fields (common.PersonalDataContext interface)
+func (e *TodoRegistered) PersonalData() map[string]string {
+	return map[string]string{personalFieldMessage: e.Message}
+}
+
+// WithoutPersonalData is copy without personal fields (common.PersonalDataContext interface)
+func (e *TodoRegistered) WithoutPersonalData() common.EventContext {
+	c := *e
+	c.Message = ""
+	return &c
+}
+
+// RestorePersonalData is restore personal fields (common.PersonalDataContext interface)
+func (e *TodoRegistered) RestorePersonalData(fields map[string]string) {
+	e.Message = fields[personalFieldMessage]
+}
+
 // TodoMessageChanged is todo message changed event
 type TodoMessageChanged struct {
 	EventID     string
@@ -71,7 +125,7 @@ func NewTodoMessageChanged(aggregateID, message string) (*TodoMessageChanged, er
 	}
 	return &TodoMessageChanged{
 		EventID:     eventID,
-		EventType:   EventTypeTodoRegistered,
+		EventType:   EventTypeTodoMessageChanged,
 		OccurredOn:  time.Now().UnixNano(),
 		AggregateID: aggregateID,
 		Message:     message,
@@ -93,6 +147,28 @@ func (e *TodoMessageChanged) GetOccurredOn() int64 {
 	return e.OccurredOn
 }
 
+// GetSchemaVersion is get schema version (common.SchemaVersionContext interface)
+func (e *TodoMessageChanged) GetSchemaVersion() int {
+	return SchemaVersionTodoMessageChanged
+}
+
+// PersonalData is personal fields (common.PersonalDataContext interface)
+func (e *TodoMessageChanged) PersonalData() map[string]string {
+	return map[string]string{personalFieldMessage: e.Message}
+}
+
+// WithoutPersonalData is copy without personal fields (common.PersonalDataContext interface)
+func (e *TodoMessageChanged) WithoutPersonalData() common.EventContext {
+	c := *e
+	c.Message = ""
+	return &c
+}
+
+// RestorePersonalData is restore personal fields (common.PersonalDataContext interface)
+func (e *TodoMessageChanged) RestorePersonalData(fields map[string]string) {
+	e.Message = fields[personalFieldMessage]
+}
+
 // TodoCompleted is todo completed event
 type TodoCompleted struct {
 	EventID     string
@@ -110,7 +186,7 @@ func NewTodoCompleted(aggregateID string, completed bool) (*TodoCompleted, error
 	}
 	return &TodoCompleted{
 		EventID:     eventID,
-		EventType:   EventTypeTodoRegistered,
+		EventType:   EventTypeTodoCompleted,
 		OccurredOn:  time.Now().UnixNano(),
 		AggregateID: aggregateID,
 		Completed:   completed,
@@ -131,3 +207,92 @@ func (e *TodoCompleted) GetEventType() string {
 func (e *TodoCompleted) GetOccurredOn() int64 {
 	return e.OccurredOn
 }
+
+// GetSchemaVersion is get schema version (common.SchemaVersionContext interface)
+func (e *TodoCompleted) GetSchemaVersion() int {
+	return SchemaVersionTodoCompleted
+}
+
+// TodoDeleted is todo deleted event (tombstone)
+type TodoDeleted struct {
+	EventID     string
+	EventType   string
+	OccurredOn  int64
+	AggregateID string
+}
+
+// NewTodoDeleted is new todo deleted
+func NewTodoDeleted(aggregateID string) (*TodoDeleted, error) {
+	eventID, err := common.NewEventID()
+	if err != nil {
+		return nil, err
+	}
+	return &TodoDeleted{
+		EventID:     eventID,
+		EventType:   EventTypeTodoDeleted,
+		OccurredOn:  time.Now().UnixNano(),
+		AggregateID: aggregateID,
+	}, nil
+}
+
+// GetEventID is get event id (common.EventContext interface)
+func (e *TodoDeleted) GetEventID() string {
+	return e.EventID
+}
+
+// GetEventType is get event type (common.EventContext interface)
+func (e *TodoDeleted) GetEventType() string {
+	return e.EventType
+}
+
+// GetOccurredOn is get occurred on (common.EventContext interface)
+func (e *TodoDeleted) GetOccurredOn() int64 {
+	return e.OccurredOn
+}
+
+// GetSchemaVersion is get schema version (common.SchemaVersionContext interface)
+func (e *TodoDeleted) GetSchemaVersion() int {
+	return SchemaVersionTodoDeleted
+}
+
+// TodoShredded is todo personal data shredded event, raised before the key is destroyed so read models drop the message
+type TodoShredded struct {
+	EventID     string
+	EventType   string
+	OccurredOn  int64
+	AggregateID string
+}
+
+// NewTodoShredded is new todo shredded
+func NewTodoShredded(aggregateID string) (*TodoShredded, error) {
+	eventID, err := common.NewEventID()
+	if err != nil {
+		return nil, err
+	}
+	return &TodoShredded{
+		EventID:     eventID,
+		EventType:   EventTypeTodoShredded,
+		OccurredOn:  time.Now().UnixNano(),
+		AggregateID: aggregateID,
+	}, nil
+}
+
+// GetEventID is get event id (common.EventContext interface)
+func (e *TodoShredded) GetEventID() string {
+	return e.EventID
+}
+
+// GetEventType is get event type (common.EventContext interface)
+func (e *TodoShredded) GetEventType() string {
+	return e.EventType
+}
+
+// GetOccurredOn is get occurred on (common.EventContext interface)
+func (e *TodoShredded) GetOccurredOn() int64 {
+	return e.OccurredOn
+}
+
+// GetSchemaVersion is get schema version (common.SchemaVersionContext interface)
+func (e *TodoShredded) GetSchemaVersion() int {
+	return SchemaVersionTodoShredded
+}
@@ -0,0 +1,63 @@
+package events
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/lightstaff/go-dddcqrses/common"
+)
+
+// Upcaster is transform JSON payload of schema version n to n+1
+type Upcaster func(data []byte) ([]byte, error)
+
+var (
+	upcastersMu sync.RWMutex
+	upcasters   = make(map[string]map[int]Upcaster)
+)
+
+// RegisterUpcaster is register upcaster from schema version of event type
+//
+// Upcasters are applied step by step (v1 -> v2 -> v3) until the current schema version of the event type.
+// nil upcaster marks additive change (new fields read as zero values), passing payload of any content type as is.
+func RegisterUpcaster(eventType string, fromVersion int, u Upcaster) {
+	upcastersMu.Lock()
+	defer upcastersMu.Unlock()
+
+	if upcasters[eventType] == nil {
+		upcasters[eventType] = make(map[int]Upcaster)
+	}
+	upcasters[eventType][fromVersion] = u
+}
+
+// Upcast is upcast payload of schema version to target schema version
+//
+// Upcasters work on JSON, so payloads of other content types can be upcast only through additive changes.
+func Upcast(eventType, contentType string, schemaVersion, targetVersion int, data []byte) ([]byte, error) {
+	upcastersMu.RLock()
+	defer upcastersMu.RUnlock()
+
+	if schemaVersion < 1 {
+		schemaVersion = 1
+	}
+	if schemaVersion > targetVersion {
+		return nil, fmt.Errorf("%s schema version %d is newer than %d", eventType, schemaVersion, targetVersion)
+	}
+	for v := schemaVersion; v < targetVersion; v++ {
+		u, ok := upcasters[eventType][v]
+		if !ok {
+			return nil, fmt.Errorf("no upcaster for %s schema version %d", eventType, v)
+		}
+		if u == nil {
+			continue
+		}
+		if contentType != "" && contentType != common.ContentTypeJSON {
+			return nil, fmt.Errorf("cannot upcast %s payload of %s", contentType, eventType)
+		}
+		d, err := u(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upcast %s schema version %d: %v", eventType, v, err)
+		}
+		data = d
+	}
+	return data, nil
+}
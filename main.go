@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/lightstaff/go-dddcqrses/command"
 	"github.com/lightstaff/go-dddcqrses/common"
@@ -21,7 +22,23 @@ func main() {
 
 	sugar := logger.Sugar()
 
-	inMemoryDB := common.NewInMemoryDB(sugar)
+	var db interface {
+		common.EventDB
+		common.OutboxDB
+		common.CausationDB
+	} = common.NewInMemoryDB(sugar)
+	if dir := os.Getenv("EVENT_STORE_DIR"); dir != "" {
+		fileDB, err := common.NewFileDB(dir, common.DefaultSegmentSize, sugar)
+		if err != nil {
+			panic(err)
+		}
+		defer fileDB.Close()
+		db = fileDB
+	}
+
+	keys := common.NewInMemoryKeyStore()
+	policy := command.DefaultTodoPolicy()
+	user := &common.Principal{ID: "user-1", Roles: []string{command.RoleTodoUser}}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -30,23 +47,49 @@ func main() {
 	errc := make(chan error)
 
 	go func() {
-		persistence := common.NewFakePersistence(inMemoryDB, sugar)
-		producer := common.NewFakeMessagingProducer(delivery, sugar)
-		commandActor := command.NewTodoActor(persistence, producer, sugar)
-		commandActor.Act(&command.TodoRegistry{
+		persistence := common.NewFakePersistence(db, sugar)
+		persistence.SetSnapshotStore(common.NewInMemorySnapshotStore(), common.EveryNEvents(100))
+		persistence.SetKeyStore(keys)
+		commandActor := command.NewTodoActor(persistence, common.NewEventProcessedCommandStore(db, 24*time.Hour), sugar)
+		commandActor.SetPolicy(policy)
+		validator := common.NewCommandValidator()
+		command.RegisterValidationRules(validator)
+		bus := common.NewCommandBus()
+		bus.Use(
+			common.LoggingMiddleware(sugar),
+			common.MetricsMiddleware(common.NewInMemoryCommandMetrics()),
+			common.ValidationMiddleware(validator),
+			common.RetryOnConflictMiddleware(common.DefaultRetryPolicy(), nil),
+		)
+		commandActor.RegisterHandlers(bus)
+		result, err := bus.Dispatch(common.WithPrincipal(ctx, user), &command.TodoRegistry{
 			Message:   "test message",
 			Completed: false,
 		})
-		sugar.Info("command actor action completed")
+		if err != nil {
+			errc <- err
+			return
+		}
+		sugar.Infow("command actor action completed", "result", result)
+	}()
+
+	go func() {
+		producer := common.NewFakeMessagingProducer(delivery, sugar)
+		relay := common.NewOutboxRelay(db, producer, sugar)
+		if err := relay.Run(ctx); err != nil && err != context.Canceled {
+			errc <- err
+		}
 	}()
 
 	go func() {
 		defer close(delivery)
 
-		persistenceQuery := common.NewFakePersistenceQuery(inMemoryDB, sugar)
+		persistenceQuery := common.NewFakePersistenceQuery(db, sugar)
+		persistenceQuery.SetKeyStore(keys)
 		consumer := common.NewFakeMessagingConsumer(delivery, sugar)
 		queryDB := query.NewFakeQueryDB(sugar)
 		queryActor := query.NewTodoActor(persistenceQuery, queryDB, sugar)
+		reader := query.NewAuthorizedQueryDB(queryDB, policy)
 
 		go func() {
 			if err := consumer.Consume(ctx, delivery); err != nil {
@@ -60,18 +103,27 @@ func main() {
 				sugar.Info("call context cancel")
 				return
 			case m := <-delivery:
-				msg, err := messages.MessageConveter(m.Header, m.Data)
+				msg, err := messages.MessageConveter(m.Header, m.ContentType, m.Data)
 				if err != nil {
 					errc <- err
 				}
 				sugar.Infow("receive message", "message", msg)
 				switch msg := msg.(type) {
 				case *messages.TodoEventOccurred:
-					if err := queryActor.Act(msg); err != nil {
+					if err := queryActor.Act(ctx, msg); err != nil {
+						errc <- err
+					}
+					sugar.Info("query actor action completed")
+					todo, err := reader.FindByID(common.WithPrincipal(ctx, user), msg.AggregateID)
+					if err != nil {
+						errc <- err
+					}
+					sugar.Infow("now todo", "todo", todo)
+				case *messages.TodoHardDeleted:
+					if err := queryActor.ActHardDeleted(ctx, msg); err != nil {
 						errc <- err
 					}
 					sugar.Info("query actor action completed")
-					sugar.Infow("now todo", "todo", queryDB.FindByID(msg.AggregateID))
 				}
 			}
 		}
@@ -1,18 +1,27 @@
 package messages
 
 import (
-	"encoding/json"
 	"errors"
 
 	"github.com/lightstaff/go-dddcqrses/common"
 )
 
-// MessageConveter is message to type
-func MessageConveter(messageType string, data []byte) (common.MessageContext, error) {
+// MessageConveter is message to type, data is decoded by serializer of content type (empty is JSON)
+func MessageConveter(messageType, contentType string, data []byte) (common.MessageContext, error) {
+	serializer, err := common.SerializerFor(contentType)
+	if err != nil {
+		return nil, err
+	}
 	switch messageType {
 	case MessageTypeTodoEventOccurred:
 		var m TodoEventOccurred
-		if err := json.Unmarshal(data, &m); err != nil {
+		if err := serializer.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	case MessageTypeTodoHardDeleted:
+		var m TodoHardDeleted
+		if err := serializer.Unmarshal(data, &m); err != nil {
 			return nil, err
 		}
 		return &m, nil
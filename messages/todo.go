@@ -3,7 +3,10 @@ package messages
 import "github.com/lightstaff/go-dddcqrses/common"
 
 // message types
-const MessageTypeTodoEventOccurred = "TodoEventOccurred"
+const (
+	MessageTypeTodoEventOccurred = "TodoEventOccurred"
+	MessageTypeTodoHardDeleted   = "TodoHardDeleted"
+)
 
 // TodoEventOccurred is todo event occurred message
 type TodoEventOccurred struct {
@@ -11,10 +14,11 @@ type TodoEventOccurred struct {
 	MessageType   string
 	AggregateID   string
 	StreamVersion int64
+	Metadata      common.EventMetadata
 }
 
 // NewTodoEventOccurred is new todo event occurred event
-func NewTodoEventOccurred(aggregateID string, streamVersion int64) (*TodoEventOccurred, error) {
+func NewTodoEventOccurred(aggregateID string, streamVersion int64, metadata common.EventMetadata) (*TodoEventOccurred, error) {
 	messageID, err := common.NewMessageID()
 	if err != nil {
 		return nil, err
@@ -24,6 +28,7 @@ func NewTodoEventOccurred(aggregateID string, streamVersion int64) (*TodoEventOc
 		MessageType:   MessageTypeTodoEventOccurred,
 		AggregateID:   aggregateID,
 		StreamVersion: streamVersion,
+		Metadata:      metadata,
 	}, nil
 }
 
@@ -36,3 +41,35 @@ func (m *TodoEventOccurred) GetMessageID() string {
 func (m *TodoEventOccurred) GetMessageType() string {
 	return m.MessageType
 }
+
+// TodoHardDeleted is todo hard deleted message, the stream of todo is removed so read models drop it
+type TodoHardDeleted struct {
+	MessageID   string
+	MessageType string
+	AggregateID string
+	Metadata    common.EventMetadata
+}
+
+// NewTodoHardDeleted is new todo hard deleted message
+func NewTodoHardDeleted(aggregateID string, metadata common.EventMetadata) (*TodoHardDeleted, error) {
+	messageID, err := common.NewMessageID()
+	if err != nil {
+		return nil, err
+	}
+	return &TodoHardDeleted{
+		MessageID:   messageID,
+		MessageType: MessageTypeTodoHardDeleted,
+		AggregateID: aggregateID,
+		Metadata:    metadata,
+	}, nil
+}
+
+// GetMessageID is get message id (common.MessageContext interface)
+func (m *TodoHardDeleted) GetMessageID() string {
+	return m.MessageID
+}
+
+// GetMessageType is get message type (common.MessageContext interface)
+func (m *TodoHardDeleted) GetMessageType() string {
+	return m.MessageType
+}
@@ -1,15 +1,61 @@
 package query
 
-import "go.uber.org/zap"
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/lightstaff/go-dddcqrses/common"
+)
 
 // QueryDBContext is query db interface
 type QueryDBContext interface {
-	FindByID(id string) *TodoQuery
-	Save(entity *TodoQuery)
+	// FindByID is find by id, nil when not exists
+	FindByID(ctx context.Context, id string) (*TodoQuery, error)
+	Save(ctx context.Context, entity *TodoQuery) error
+	Delete(ctx context.Context, id string) error
+}
+
+// ActionTodoRead is read todo action authorized by policy
+const ActionTodoRead = "todo.read"
+
+// AuthorizedQueryDB is query db reading only todos the principal of context is allowed to read
+//
+// Save and Delete are projection writes and pass through unchecked.
+type AuthorizedQueryDB struct {
+	QueryDBContext
+	policy common.Policy
+}
+
+// NewAuthorizedQueryDB is new authorized query db
+func NewAuthorizedQueryDB(db QueryDBContext, policy common.Policy) *AuthorizedQueryDB {
+	return &AuthorizedQueryDB{
+		QueryDBContext: db,
+		policy:         policy,
+	}
+}
+
+// FindByID is find by id, *common.ErrForbidden when principal is not allowed to read it
+func (db *AuthorizedQueryDB) FindByID(ctx context.Context, id string) (*TodoQuery, error) {
+	entity, err := db.QueryDBContext.FindByID(ctx, id)
+	if err != nil || entity == nil {
+		return entity, err
+	}
+	if _, err := common.Authorize(ctx, db.policy, ActionTodoRead, id, map[string]string{
+		common.AttributeOwner: entity.Owner,
+	}); err != nil {
+		return nil, err
+	}
+	return entity, nil
 }
 
 // FakeQueryDB is fake query db
+//
+// FakeQueryDB is safe for concurrent use. Entities are copied on write and read.
 type FakeQueryDB struct {
+	mu     sync.RWMutex
 	data   map[string]*TodoQuery
 	logger *zap.SugaredLogger
 }
@@ -23,14 +69,76 @@ func NewFakeQueryDB(logger *zap.SugaredLogger) *FakeQueryDB {
 }
 
 // FindByID is find by id
-func (db *FakeQueryDB) FindByID(id string) *TodoQuery {
+func (db *FakeQueryDB) FindByID(ctx context.Context, id string) (*TodoQuery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
 	if entity, ok := db.data[id]; ok {
-		return entity
+		return entity.clone(), nil
 	}
-	return nil
+	return nil, nil
+}
+
+// FindAll is find all entities at one point in time, sorted by aggregate id
+func (db *FakeQueryDB) FindAll(ctx context.Context) ([]*TodoQuery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	results := make([]*TodoQuery, 0, len(db.data))
+	for _, entity := range db.data {
+		results = append(results, entity.clone())
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].AggregateID < results[j].AggregateID
+	})
+	return results, nil
 }
 
 // Save is save entity
-func (db *FakeQueryDB) Save(entity *TodoQuery) {
-	db.data[entity.AggregateID] = entity
+func (db *FakeQueryDB) Save(ctx context.Context, entity *TodoQuery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.data[entity.AggregateID] = entity.clone()
+	return nil
+}
+
+// Delete is delete entity
+func (db *FakeQueryDB) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.data, id)
+	return nil
+}
+
+// Clone is consistent point in time copy of database
+func (db *FakeQueryDB) Clone() *FakeQueryDB {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	c := &FakeQueryDB{
+		data:   make(map[string]*TodoQuery, len(db.data)),
+		logger: db.logger,
+	}
+	for id, entity := range db.data {
+		c.data[id] = entity.clone()
+	}
+	return c
 }
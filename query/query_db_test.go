@@ -0,0 +1,124 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestFakeQueryDBConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	db := NewFakeQueryDB(zap.NewNop().Sugar())
+
+	const workers, rows = 10, 100
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(3)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rows; i++ {
+				if err := db.Save(ctx, &TodoQuery{AggregateID: fmt.Sprint(i), Message: fmt.Sprint(w), StreamVersion: int64(w)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rows; i++ {
+				entity, err := db.FindByID(ctx, fmt.Sprint(i))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if entity != nil {
+					entity.Message = "changed by reader"
+				}
+				all, err := db.FindAll(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, entity := range all {
+					entity.Message = "changed by reader"
+				}
+			}
+		}()
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rows; i++ {
+				if i%workers == w {
+					if err := db.Delete(ctx, fmt.Sprintf("tmp-%d", i)); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				db.Clone()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	all, err := db.FindAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != rows {
+		t.Fatalf("got %d rows, want %d", len(all), rows)
+	}
+	for _, entity := range all {
+		if entity.Message == "changed by reader" {
+			t.Fatalf("row %s was changed by reader", entity.AggregateID)
+		}
+	}
+}
+
+func TestFakeQueryDBConcurrentDelete(t *testing.T) {
+	ctx := context.Background()
+	db := NewFakeQueryDB(zap.NewNop().Sugar())
+
+	const rows = 200
+	for i := 0; i < rows; i++ {
+		if err := db.Save(ctx, &TodoQuery{AggregateID: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < rows; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Delete(ctx, fmt.Sprint(i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			// a clone is one point in time, so FindAll and FindByID on it agree
+			c := db.Clone()
+			all, err := c.FindAll(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, entity := range all {
+				if found, _ := c.FindByID(ctx, entity.AggregateID); found == nil {
+					t.Errorf("row %s is in FindAll but not FindByID of clone", entity.AggregateID)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	all, err := db.FindAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 0 {
+		t.Fatalf("got %d rows, want 0", len(all))
+	}
+}
@@ -1,6 +1,8 @@
 package query
 
 import (
+	"context"
+
 	"github.com/lightstaff/go-dddcqrses/common"
 	"github.com/lightstaff/go-dddcqrses/events"
 	"github.com/lightstaff/go-dddcqrses/messages"
@@ -24,27 +26,50 @@ func NewTodoActor(persistenceQuery common.PersistenceQueryContext, queryDB Query
 }
 
 // Act is todo actor action
-func (t *TodoActor) Act(msg *messages.TodoEventOccurred) error {
-	target := t.queryDB.FindByID(msg.AggregateID)
-	if target == nil {
+func (t *TodoActor) Act(ctx context.Context, msg *messages.TodoEventOccurred) error {
+	target, err := t.queryDB.FindByID(ctx, msg.AggregateID)
+	if err != nil {
+		return err
+	}
+	found := target != nil
+	if !found {
 		target = &TodoQuery{
 			AggregateID: msg.AggregateID,
 		}
 	}
-	storedEvents, err := t.persistenceQuery.QueryEvents(msg.AggregateID, target.StreamVersion, msg.StreamVersion)
+	storedEvents, err := t.persistenceQuery.QueryEvents(ctx, msg.AggregateID, target.StreamVersion+1, msg.StreamVersion)
 	if err != nil {
 		return err
 	}
 	t.logger.Infow("apply events", "events", storedEvents)
 	for _, storedEvent := range storedEvents {
-		e, err := events.EventConverter(storedEvent.EventType, storedEvent.Data)
+		if storedEvent.StreamVersion <= target.StreamVersion {
+			continue
+		}
+		e, err := events.EventConverter(storedEvent)
 		if err != nil {
 			return err
 		}
-		target.ApplyEvent(e)
+		if err := target.ApplyEvent(e); err != nil {
+			return err
+		}
 		target.StreamVersion = storedEvent.StreamVersion
+		target.LastEventID = storedEvent.EventID
+		target.Metadata = storedEvent.Metadata
 		t.logger.Infow("apply event", "event", e)
 	}
-	t.queryDB.Save(target)
-	return nil
+	if target.Deleted {
+		return t.queryDB.Delete(ctx, target.AggregateID)
+	}
+	// the stream is gone (hard deleted) before a late message, so there is nothing to project
+	if !found && target.StreamVersion == 0 {
+		return nil
+	}
+	return t.queryDB.Save(ctx, target)
+}
+
+// ActHardDeleted is todo actor action on hard deleted todo, drop it
+func (t *TodoActor) ActHardDeleted(ctx context.Context, msg *messages.TodoHardDeleted) error {
+	t.logger.Infow("drop todo", "aggregateID", msg.AggregateID)
+	return t.queryDB.Delete(ctx, msg.AggregateID)
 }
@@ -6,23 +6,59 @@ import (
 )
 
 // TodoQuery is todo query model
+//
+// LastEventID and Metadata are of last applied event, Deleted is set by tombstone and the row is dropped.
+// Message is cleared when the todo is shredded.
 type TodoQuery struct {
 	AggregateID   string
+	Owner         string
 	Message       string
 	Completed     bool
+	Deleted       bool
 	StreamVersion int64
+	LastEventID   string
+	Metadata      common.EventMetadata
 }
 
-// ApplyEvent is apply event
-func (t *TodoQuery) ApplyEvent(e common.EventContext) error {
-	switch e := e.(type) {
-	case *events.TodoRegistered:
+// clone is deep copy of todo query
+func (t *TodoQuery) clone() *TodoQuery {
+	c := *t
+	if t.Metadata.Headers != nil {
+		c.Metadata.Headers = make(map[string]string, len(t.Metadata.Headers))
+		for k, v := range t.Metadata.Headers {
+			c.Metadata.Headers[k] = v
+		}
+	}
+	return &c
+}
+
+// todoQueryRouter is apply handlers of TodoQuery
+var todoQueryRouter = newTodoQueryRouter()
+
+// newTodoQueryRouter is new apply handlers of TodoQuery, panic when a todo event is not handled
+func newTodoQueryRouter() *common.EventRouter[*TodoQuery] {
+	r := common.NewEventRouter[*TodoQuery]()
+	common.On(r, func(t *TodoQuery, e *events.TodoRegistered) {
+		t.Owner = e.Owner
 		t.Message = e.Message
 		t.Completed = e.Completed
-	case *events.TodoMessageChanged:
+	})
+	common.On(r, func(t *TodoQuery, e *events.TodoMessageChanged) {
 		t.Message = e.Message
-	case *events.TodoCompleted:
+	})
+	common.On(r, func(t *TodoQuery, e *events.TodoCompleted) {
 		t.Completed = e.Completed
-	}
-	return nil
+	})
+	common.On(r, func(t *TodoQuery, e *events.TodoDeleted) {
+		t.Deleted = true
+	})
+	common.On(r, func(t *TodoQuery, e *events.TodoShredded) {
+		t.Message = ""
+	})
+	return r.MustHandle(events.TodoEvents()...)
+}
+
+// ApplyEvent is apply event
+func (t *TodoQuery) ApplyEvent(e common.EventContext) error {
+	return todoQueryRouter.Route(t, e)
 }